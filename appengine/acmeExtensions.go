@@ -0,0 +1,279 @@
+package appengine
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	_ "crypto/sha256" // For crypto.SHA256.
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/urlfetch"
+)
+
+// The acme package only understands the directory fields and order options
+// from RFC 8555.  This file has the parts of newer ACME extensions we use.
+
+// directoryExtensions are the fields of an ACME directory the acme package
+// doesn't know about.
+type directoryExtensions struct {
+	NewNonce    string `json:"newNonce"`
+	NewOrder    string `json:"newOrder"`
+	RenewalInfo string `json:"renewalInfo"` // ACME Renewal Information.
+
+	Meta struct {
+		// Certificate profiles the CA offers, with their descriptions.
+		Profiles map[string]string `json:"profiles"`
+	} `json:"meta"`
+}
+
+// fetchDirectoryExtensions reads the CA's directory.
+func fetchDirectoryExtensions(c context.Context, directoryURL string) (*directoryExtensions, error) {
+	resp, err := urlfetch.Client(c).Get(directoryURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching directory %s returned %s", directoryURL, resp.Status)
+	}
+
+	var ret directoryExtensions
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, fmt.Errorf("Failed to decode directory %s: %v", directoryURL, err)
+	}
+	return &ret, nil
+}
+
+// authorizeOrderWithProfile is client.AuthorizeOrder for a certificate
+// profile, which the acme package can't ask for.  The profile decides the
+// certificate's lifetime, CAs like Let's Encrypt reject orders that ask for
+// notAfter as well.
+func authorizeOrderWithProfile(c context.Context, client *acme.Client, hostnames []string, profile string) (*acme.Order, error) {
+	dir, err := fetchDirectoryExtensions(c, client.DirectoryURL)
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := dir.Meta.Profiles[profile]; !ok {
+		return nil, fmt.Errorf("%s doesn't offer the '%s' profile", caName(client.DirectoryURL), profile)
+	}
+
+	type identifier struct {
+		Type  string `json:"type"`
+		Value string `json:"value"`
+	}
+	req := struct {
+		Identifiers []identifier `json:"identifiers"`
+		Profile     string       `json:"profile"`
+	}{Profile: profile}
+	for _, id := range orderIdentifiers(hostnames) {
+		req.Identifiers = append(req.Identifiers, identifier{id.Type, id.Value})
+	}
+
+	resp, err := postJWS(c, client, dir.NewNonce, dir.NewOrder, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return nil, responseError(resp)
+	}
+
+	var order struct {
+		Status         string
+		Authorizations []string
+		Finalize       string
+		Error          *acme.Error
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&order); err != nil {
+		return nil, fmt.Errorf("Failed to decode order: %v", err)
+	}
+	return &acme.Order{
+		URI:         resp.Header.Get("Location"),
+		Status:      order.Status,
+		AuthzURLs:   order.Authorizations,
+		FinalizeURL: order.Finalize,
+		Error:       order.Error,
+	}, nil
+}
+
+// orderIdentifiers returns the identifiers to order a certificate for the
+// hostnames with, the same as the acme package would.
+func orderIdentifiers(hostnames []string) []acme.AuthzID {
+	var ret []acme.AuthzID
+	for _, hostname := range hostnames {
+		if net.ParseIP(hostname) != nil {
+			ret = append(ret, acme.IPIDs(hostname)...)
+		} else {
+			ret = append(ret, acme.DomainIDs(hostname)...)
+		}
+	}
+	return ret
+}
+
+// postJWS sends payload to url signed with the client's account key, as
+// described in RFC 8555 section 6.2.  If the CA rejects the nonce it's tried
+// once more with a new one (section 6.5).
+func postJWS(c context.Context, client *acme.Client, nonceURL, url string, payload interface{}) (*http.Response, error) {
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = urlfetch.Client(c)
+	}
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := fetchNonce(client, httpClient, nonceURL)
+	if err != nil {
+		return nil, err
+	}
+	for retried := false; ; retried = true {
+		body, err := signJWS(client, nonce, url, payloadJSON)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/jose+json")
+		if client.UserAgent != "" {
+			req.Header.Set("User-Agent", client.UserAgent)
+		}
+		resp, err := httpClient.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		if retried || resp.StatusCode != http.StatusBadRequest {
+			return resp, nil
+		}
+
+		// Read the problem to see if it was the nonce, leaving it to be read
+		// again if it wasn't.
+		problemJSON, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = io.NopCloser(bytes.NewReader(problemJSON))
+		var problem struct{ Type string }
+		if json.Unmarshal(problemJSON, &problem) != nil || problem.Type != acmeErrorPrefix+"badNonce" {
+			return resp, nil
+		}
+
+		// The error response usually has a new nonce.
+		if nonce = resp.Header.Get("Replay-Nonce"); nonce == "" {
+			if nonce, err = fetchNonce(client, httpClient, nonceURL); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// fetchNonce gets a new anti-replay nonce from the CA.
+func fetchNonce(client *acme.Client, httpClient *http.Client, nonceURL string) (string, error) {
+	req, err := http.NewRequest("HEAD", nonceURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if client.UserAgent != "" {
+		req.Header.Set("User-Agent", client.UserAgent)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get nonce: %v", err)
+	}
+	resp.Body.Close()
+	nonce := resp.Header.Get("Replay-Nonce")
+	if nonce == "" {
+		return "", fmt.Errorf("No nonce from %s", nonceURL)
+	}
+	return nonce, nil
+}
+
+// signJWS returns the flattened JWS of payloadJSON signed with the client's
+// account key.
+func signJWS(client *acme.Client, nonce, url string, payloadJSON []byte) ([]byte, error) {
+	alg, hash, err := jwsAlgorithm(client.Key)
+	if err != nil {
+		return nil, err
+	}
+	protected, err := json.Marshal(map[string]string{
+		"alg":   alg,
+		"kid":   string(client.KID),
+		"nonce": nonce,
+		"url":   url,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	signingInput := b64(protected) + "." + b64(payloadJSON)
+	digest := hash.New()
+	digest.Write([]byte(signingInput))
+	sig, err := jwsSign(client.Key, hash, digest.Sum(nil))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to sign request: %v", err)
+	}
+
+	return json.Marshal(map[string]string{
+		"protected": b64(protected),
+		"payload":   b64(payloadJSON),
+		"signature": b64(sig),
+	})
+}
+
+// jwsAlgorithm returns the JWS algorithm for signing with the key.
+func jwsAlgorithm(key crypto.Signer) (string, crypto.Hash, error) {
+	switch k := key.Public().(type) {
+	case *rsa.PublicKey:
+		return "RS256", crypto.SHA256, nil
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().Name == "P-256" {
+			return "ES256", crypto.SHA256, nil
+		}
+	}
+	return "", 0, fmt.Errorf("Unsupported account key type %T", key.Public())
+}
+
+// jwsSign signs the digest in the format JWS expects.  ECDSA signatures are the
+// fixed-size r and s rather than ASN.1.
+func jwsSign(key crypto.Signer, hash crypto.Hash, digest []byte) ([]byte, error) {
+	k, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return key.Sign(rand.Reader, digest, hash)
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, k, digest)
+	if err != nil {
+		return nil, err
+	}
+	size := (k.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	r.FillBytes(sig[:size])
+	s.FillBytes(sig[size:])
+	return sig, nil
+}
+
+// responseError turns an ACME problem document into an *acme.Error.
+func responseError(resp *http.Response) error {
+	ret := &acme.Error{StatusCode: resp.StatusCode, Header: resp.Header}
+	var problem struct {
+		Type   string
+		Detail string
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&problem); err == nil {
+		ret.ProblemType = problem.Type
+		ret.Detail = problem.Detail
+	}
+	return ret
+}
@@ -0,0 +1,127 @@
+package appengine
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+)
+
+func TestJWSSign(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		key    crypto.Signer
+		alg    string
+		verify func(digest, sig []byte) bool
+	}{
+		{"RSA", rsaKey, "RS256", func(digest, sig []byte) bool {
+			return rsa.VerifyPKCS1v15(&rsaKey.PublicKey, crypto.SHA256, digest, sig) == nil
+		}},
+		{"P-256", p256Key, "ES256", func(digest, sig []byte) bool {
+			// JWS wants the 32 byte r followed by the 32 byte s.
+			if len(sig) != 64 {
+				return false
+			}
+			r := new(big.Int).SetBytes(sig[:32])
+			s := new(big.Int).SetBytes(sig[32:])
+			return ecdsa.Verify(&p256Key.PublicKey, digest, r, s)
+		}},
+		{"P-384", p384Key, "", nil},
+	}
+
+	Convey("Signs JWS requests", t, func() {
+		for _, test := range tests {
+			Convey(test.name, func() {
+				alg, hash, err := jwsAlgorithm(test.key)
+				if test.alg == "" {
+					So(err, ShouldNotBeNil)
+					return
+				}
+				So(err, ShouldBeNil)
+				So(alg, ShouldEqual, test.alg)
+				So(hash, ShouldEqual, crypto.SHA256)
+
+				digest := sha256.Sum256([]byte("signing input"))
+				sig, err := jwsSign(test.key, hash, digest[:])
+				So(err, ShouldBeNil)
+				So(test.verify(digest[:], sig), ShouldBeTrue)
+
+				other := sha256.Sum256([]byte("something else"))
+				So(test.verify(other[:], sig), ShouldBeFalse)
+			})
+		}
+	})
+}
+
+func TestPostJWSRetriesBadNonce(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var nonces, userAgents []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		userAgents = append(userAgents, r.UserAgent())
+		if r.Method == "HEAD" {
+			w.Header().Set("Replay-Nonce", "first")
+			return
+		}
+
+		var jws struct{ Protected string }
+		json.NewDecoder(r.Body).Decode(&jws)
+		protected, _ := base64.RawURLEncoding.DecodeString(jws.Protected)
+		var header struct{ Nonce string }
+		json.Unmarshal(protected, &header)
+		nonces = append(nonces, header.Nonce)
+
+		if header.Nonce == "first" {
+			w.Header().Set("Replay-Nonce", "second")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"type": "urn:ietf:params:acme:error:badNonce"}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	client := &acme.Client{
+		Key:        key,
+		KID:        "https://ca.example/acct/1",
+		HTTPClient: server.Client(),
+		UserAgent:  "gacertsbot-test",
+	}
+
+	Convey("Retries once with the nonce from a badNonce error", t, func() {
+		resp, err := postJWS(context.Background(), client, server.URL+"/nonce", server.URL+"/order", map[string]string{})
+		So(err, ShouldBeNil)
+		resp.Body.Close()
+		So(resp.StatusCode, ShouldEqual, http.StatusCreated)
+		So(nonces, ShouldResemble, []string{"first", "second"})
+		So(userAgents, ShouldResemble, []string{"gacertsbot-test", "gacertsbot-test", "gacertsbot-test"})
+	})
+}
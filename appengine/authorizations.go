@@ -0,0 +1,58 @@
+package appengine
+
+import (
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// Don't reuse authorizations that are about to expire, the order might not
+	// be finalized in time.
+	authorizationReuseMargin = time.Hour
+)
+
+// reusableAuthorizations returns the client's cached authorizations that are
+// valid for long enough to be used in a new order, keyed by URL.  Failures are
+// logged and the authorizations are fetched from the CA instead.
+func reusableAuthorizations(c context.Context, client *acme.Client) map[string]*CachedAuthorization {
+	cached, err := GetCachedAuthorizations(c, client.DirectoryURL, string(client.KID))
+	if err != nil {
+		log.Warningf(c, "Failed to get cached authorizations: %v", err)
+		return nil
+	}
+	deadline := time.Now().Add(authorizationReuseMargin)
+	for uri, auth := range cached {
+		if auth.Expires.Before(deadline) {
+			delete(cached, uri)
+		}
+	}
+	return cached
+}
+
+// cacheAuthorization remembers a valid authorization so later orders don't
+// have to fetch it again.  If it can't be saved the next order just fetches
+// it from the CA.
+func cacheAuthorization(c context.Context, client *acme.Client, auth *acme.Authorization) {
+	if auth.Status != acme.StatusValid || auth.Expires.IsZero() {
+		return
+	}
+	hostname := auth.Identifier.Value
+	if auth.Wildcard {
+		hostname = "*." + hostname
+	}
+	cached := &CachedAuthorization{
+		HostName:     hostname,
+		DirectoryURL: client.DirectoryURL,
+		AccountID:    string(client.KID),
+		URI:          auth.URI,
+		Expires:      auth.Expires,
+	}
+	if err := cached.Put(c); err != nil {
+		log.Warningf(c, "Failed to cache authorization for %s: %v", hostname, err)
+		return
+	}
+	log.Infof(c, "Authorization for %s is valid until %s", hostname, auth.Expires)
+}
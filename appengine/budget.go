@@ -0,0 +1,164 @@
+package appengine
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/publicsuffix"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// Let's Encrypt's certificates per registered domain and duplicate
+	// certificate limits.
+	defaultCertsPerDomainBudget = 50
+	defaultDuplicateCertBudget  = 5
+
+	// The period the budgets apply to.
+	issuanceBudgetPeriod = 7 * 24 * time.Hour
+)
+
+// budgetError is returned when getting a certificate would use more of a CA's
+// rate limit than the configured budget allows.
+type budgetError struct {
+	DirectoryURL string
+	Reason       string
+	Until        time.Time // When there will be budget again.
+}
+
+func (e *budgetError) Error() string {
+	return fmt.Sprintf("Deferred to stay within the %s rate limit budget: %s until %s",
+		caName(e.DirectoryURL), e.Reason, e.Until.Format("2 January 2006 15:04"))
+}
+
+// issuanceBudget counts the certificates recently issued by one CA.
+type issuanceBudget struct {
+	directoryURL string
+	perDomain    int
+	duplicate    int
+
+	// Issue times of recent certificates, oldest first, keyed by registered
+	// domain and by set of hostnames.
+	domains map[string][]time.Time
+	sets    map[string][]time.Time
+}
+
+// loadIssuanceBudget counts the certificates the CA issued during the last
+// budget period.
+func loadIssuanceBudget(c context.Context, config *Config, directoryURL string) (*issuanceBudget, error) {
+	issuances, err := GetIssuancesSince(c, directoryURL, time.Now().Add(-issuanceBudgetPeriod))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get recent certificates: %v", err)
+	}
+	sort.Slice(issuances, func(i, j int) bool { return issuances[i].Issued.Before(issuances[j].Issued) })
+
+	b := &issuanceBudget{
+		directoryURL: directoryURL,
+		perDomain:    config.CertsPerDomainBudget,
+		duplicate:    config.DuplicateCertBudget,
+		domains:      map[string][]time.Time{},
+		sets:         map[string][]time.Time{},
+	}
+	for _, iss := range issuances {
+		b.add(iss.HostNames, iss.Issued)
+	}
+	return b, nil
+}
+
+func (b *issuanceBudget) add(hostnames []string, issued time.Time) {
+	for _, domain := range registeredDomains(hostnames) {
+		b.domains[domain] = append(b.domains[domain], issued)
+	}
+	set := hostNameSet(hostnames)
+	b.sets[set] = append(b.sets[set], issued)
+}
+
+// check returns a *budgetError if getting a certificate for the hostnames
+// would go over budget.
+func (b *issuanceBudget) check(hostnames []string) error {
+	for _, domain := range registeredDomains(hostnames) {
+		if issued := b.domains[domain]; b.perDomain > 0 && len(issued) >= b.perDomain {
+			return &budgetError{
+				DirectoryURL: b.directoryURL,
+				Reason:       fmt.Sprintf("%d certificates for %s this week", len(issued), domain),
+				Until:        issued[len(issued)-b.perDomain].Add(issuanceBudgetPeriod),
+			}
+		}
+	}
+	if issued := b.sets[hostNameSet(hostnames)]; b.duplicate > 0 && len(issued) >= b.duplicate {
+		return &budgetError{
+			DirectoryURL: b.directoryURL,
+			Reason:       fmt.Sprintf("%d duplicate certificates for %s this week", len(issued), strings.Join(hostnames, ", ")),
+			Until:        issued[len(issued)-b.duplicate].Add(issuanceBudgetPeriod),
+		}
+	}
+	return nil
+}
+
+// reserve counts a certificate that's about to be requested, so later checks
+// in the same request take it into account.
+func (b *issuanceBudget) reserve(hostnames []string) {
+	b.add(hostnames, time.Now())
+}
+
+// Remaining returns how many more certificates can be issued for the
+// hostname's registered domain this week.  Unlimited budgets return -1.
+func (b *issuanceBudget) Remaining(hostname string) int {
+	if b.perDomain <= 0 {
+		return -1
+	}
+	if remaining := b.perDomain - len(b.domains[registeredDomain(hostname)]); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+// recordIssuance saves a certificate issued for the operation against its CA's
+// budget.  The certificate has already been issued by then, so if it can't be
+// saved the budget just undercounts it.
+func recordIssuance(c context.Context, cr *CreateOperation) {
+	iss := &Issuance{
+		DirectoryURL:      cr.DirectoryURL,
+		HostNames:         cr.AllHostNames(),
+		RegisteredDomains: registeredDomains(cr.AllHostNames()),
+		Issued:            cr.Issued,
+	}
+	if err := iss.Put(c); err != nil {
+		log.Warningf(c, "Failed to record issuance for %s: %v", strings.Join(iss.HostNames, ", "), err)
+	}
+}
+
+// registeredDomain returns the domain the hostname was registered under, using
+// the public suffix list.  eg. example.co.uk for *.www.example.co.uk.
+func registeredDomain(hostname string) string {
+	hostname = strings.ToLower(strings.TrimPrefix(hostname, "*."))
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(hostname); err == nil {
+		return domain
+	}
+	return hostname
+}
+
+// registeredDomains returns the distinct registered domains of the hostnames.
+func registeredDomains(hostnames []string) []string {
+	var ret []string
+	for _, hostname := range hostnames {
+		if domain := registeredDomain(hostname); !containsString(ret, domain) {
+			ret = append(ret, domain)
+		}
+	}
+	return ret
+}
+
+// hostNameSet identifies a set of hostnames regardless of their order, for
+// counting duplicate certificates.
+func hostNameSet(hostnames []string) string {
+	sorted := make([]string, len(hostnames))
+	for i, hostname := range hostnames {
+		sorted[i] = strings.ToLower(hostname)
+	}
+	sort.Strings(sorted)
+	return strings.Join(sorted, ",")
+}
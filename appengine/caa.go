@@ -0,0 +1,166 @@
+package appengine
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/miekg/dns"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// CAA properties with this flag set must be understood by the CA.
+	caaCriticalFlag = 128
+)
+
+// caaIssuerDomains are the issuer domain names the known CAs look for in CAA
+// records.
+var caaIssuerDomains = map[string]string{
+	acme.LetsEncryptURL:    "letsencrypt.org",
+	letsEncryptStagingURL:  "letsencrypt.org",
+	zeroSSLURL:             "sectigo.com",
+	googleTrustServicesURL: "pki.goog",
+}
+
+// caaError is returned when a domain's CAA records don't allow a CA to issue
+// certificates for it.
+type caaError struct {
+	HostName     string
+	DirectoryURL string
+	Reason       string
+}
+
+func (e *caaError) Error() string {
+	return fmt.Sprintf("CAA records for %s don't allow %s to issue certificates: %s",
+		e.HostName, caName(e.DirectoryURL), e.Reason)
+}
+
+// checkCAA checks the hostname's CAA records allow the CA to issue a
+// certificate to the given account, the same way the CA will (RFC 8659 and
+// RFC 8657).  Errors looking up the records are logged and otherwise ignored,
+// the CA gets the final say.
+func checkCAA(c context.Context, hostname, directoryURL, accountURI string) error {
+	issuer, ok := caaIssuerDomains[directoryURL]
+	if !ok {
+		log.Infof(c, "Don't know the CAA issuer domain of %s, not checking CAA for %s", directoryURL, hostname)
+		return nil
+	}
+
+	name, records, err := relevantCAA(hostname, func(fqdn string) ([]*dns.CAA, error) {
+		return lookupCAA(c, fqdn)
+	})
+	if err != nil {
+		log.Warningf(c, "Failed to look up CAA records for %s: %v", hostname, err)
+		return nil
+	}
+	if reason := caaRefusal(hostname, name, issuer, accountURI, records); reason != "" {
+		return &caaError{hostname, directoryURL, reason}
+	}
+	return nil
+}
+
+// caaRefusal returns why the CAA records found at name don't allow the CA with
+// the given issuer domain to issue a certificate for hostname to the account,
+// or "" if they do.
+func caaRefusal(hostname, name, issuer, accountURI string, records []*dns.CAA) string {
+	var issue, issueWild []*dns.CAA
+	for _, rr := range records {
+		switch strings.ToLower(rr.Tag) {
+		case "issue":
+			issue = append(issue, rr)
+		case "issuewild":
+			issueWild = append(issueWild, rr)
+		case "iodef":
+		default:
+			if rr.Flag&caaCriticalFlag != 0 {
+				return fmt.Sprintf("%s has an unknown critical property '%s'", name, rr.Tag)
+			}
+		}
+	}
+
+	// Wildcards use issuewild if there are any, otherwise issue.
+	properties := issue
+	if strings.HasPrefix(hostname, "*.") && len(issueWild) > 0 {
+		properties = issueWild
+	}
+	if len(properties) == 0 {
+		return ""
+	}
+
+	var allowed []string
+	for _, rr := range properties {
+		allowed = append(allowed, rr.Value)
+		domain, params := parseCAAValue(rr.Value)
+		if !strings.EqualFold(domain, issuer) {
+			continue
+		}
+		if uri, ok := params["accounturi"]; ok && uri != accountURI {
+			continue
+		}
+		return ""
+	}
+	return fmt.Sprintf("%s only allows %s", name, strings.Join(allowed, ", "))
+}
+
+// relevantCAA finds the CAA records that apply to the hostname by climbing the
+// DNS tree until a name has some.  It returns the name they were found at.
+// lookup returns the CAA records at a fully qualified name.
+func relevantCAA(hostname string, lookup func(fqdn string) ([]*dns.CAA, error)) (string, []*dns.CAA, error) {
+	name := strings.TrimSuffix(strings.TrimPrefix(hostname, "*."), ".")
+	for name != "" {
+		records, err := lookup(dns.Fqdn(name))
+		if err != nil {
+			return "", nil, err
+		}
+		if len(records) != 0 {
+			return name, records, nil
+		}
+
+		// Try the parent domain.
+		if i := strings.Index(name, "."); i >= 0 {
+			name = name[i+1:]
+		} else {
+			name = ""
+		}
+	}
+	return "", nil, nil
+}
+
+// lookupCAA returns the CAA records at fqdn, following any CNAMEs.
+func lookupCAA(c context.Context, fqdn string) ([]*dns.CAA, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeCAA)
+	resp, err := exchangeDNS(c, m, dnsResolver, nil)
+	if err != nil {
+		return nil, fmt.Errorf("CAA lookup for %s failed: %v", fqdn, err)
+	}
+	switch resp.Rcode {
+	case dns.RcodeSuccess, dns.RcodeNameError:
+	default:
+		return nil, fmt.Errorf("CAA lookup for %s failed: %s", fqdn, dns.RcodeToString[resp.Rcode])
+	}
+
+	var ret []*dns.CAA
+	for _, rr := range resp.Answer {
+		if caa, ok := rr.(*dns.CAA); ok {
+			ret = append(ret, caa)
+		}
+	}
+	return ret, nil
+}
+
+// parseCAAValue splits the value of an issue or issuewild property into the
+// issuer domain name and its parameters, eg.
+// "letsencrypt.org; accounturi=https://...".
+func parseCAAValue(value string) (string, map[string]string) {
+	parts := strings.Split(value, ";")
+	params := map[string]string{}
+	for _, part := range parts[1:] {
+		if kv := strings.SplitN(strings.TrimSpace(part), "=", 2); len(kv) == 2 {
+			params[strings.ToLower(strings.TrimSpace(kv[0]))] = strings.TrimSpace(kv[1])
+		}
+	}
+	return strings.TrimSpace(parts[0]), params
+}
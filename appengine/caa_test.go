@@ -0,0 +1,120 @@
+package appengine
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func caa(flag uint8, tag, value string) *dns.CAA {
+	return &dns.CAA{Flag: flag, Tag: tag, Value: value}
+}
+
+func TestCAARefusal(t *testing.T) {
+	const account = "https://acme-v02.api.letsencrypt.org/acme/acct/1"
+
+	tests := []struct {
+		name     string
+		hostname string
+		records  []*dns.CAA
+		allowed  bool
+	}{
+		{"No records", "example.com", nil, true},
+		{"Issuer allowed", "example.com",
+			[]*dns.CAA{caa(0, "issue", "letsencrypt.org")}, true},
+		{"Issuer domain is case insensitive", "example.com",
+			[]*dns.CAA{caa(0, "issue", "LetsEncrypt.org")}, true},
+		{"Other issuer", "example.com",
+			[]*dns.CAA{caa(0, "issue", "pki.goog")}, false},
+		{"One of several issuers", "example.com",
+			[]*dns.CAA{caa(0, "issue", "pki.goog"), caa(0, "issue", "letsencrypt.org")}, true},
+		{"Nobody may issue", "example.com",
+			[]*dns.CAA{caa(0, "issue", ";")}, false},
+		{"Only iodef", "example.com",
+			[]*dns.CAA{caa(0, "iodef", "mailto:security@example.com")}, true},
+		{"Wildcard falls back to issue", "*.example.com",
+			[]*dns.CAA{caa(0, "issue", "pki.goog")}, false},
+		{"Wildcard allowed by issue", "*.example.com",
+			[]*dns.CAA{caa(0, "issue", "letsencrypt.org")}, true},
+		{"issuewild overrides issue for wildcards", "*.example.com",
+			[]*dns.CAA{caa(0, "issue", "pki.goog"), caa(0, "issuewild", "letsencrypt.org")}, true},
+		{"issuewild refuses wildcards", "*.example.com",
+			[]*dns.CAA{caa(0, "issue", "letsencrypt.org"), caa(0, "issuewild", ";")}, false},
+		{"issuewild doesn't apply to other names", "www.example.com",
+			[]*dns.CAA{caa(0, "issue", "pki.goog"), caa(0, "issuewild", "letsencrypt.org")}, false},
+		{"Unknown critical property", "example.com",
+			[]*dns.CAA{caa(0, "issue", "letsencrypt.org"), caa(caaCriticalFlag, "tbs", "x")}, false},
+		{"Unknown non-critical property", "example.com",
+			[]*dns.CAA{caa(0, "issue", "letsencrypt.org"), caa(0, "tbs", "x")}, true},
+		{"accounturi matches", "example.com",
+			[]*dns.CAA{caa(0, "issue", "letsencrypt.org; accounturi="+account)}, true},
+		{"accounturi mismatch", "example.com",
+			[]*dns.CAA{caa(0, "issue", "letsencrypt.org; accounturi=https://acme-v02.api.letsencrypt.org/acme/acct/2")}, false},
+		{"validationmethods is ignored", "example.com",
+			[]*dns.CAA{caa(0, "issue", "letsencrypt.org; validationmethods=dns-01")}, true},
+	}
+
+	Convey("Checks CAA records", t, func() {
+		for _, test := range tests {
+			Convey(test.name, func() {
+				reason := caaRefusal(test.hostname, "example.com", "letsencrypt.org", account, test.records)
+				if test.allowed {
+					So(reason, ShouldEqual, "")
+				} else {
+					So(reason, ShouldNotEqual, "")
+				}
+			})
+		}
+	})
+}
+
+func TestRelevantCAA(t *testing.T) {
+	zone := map[string][]*dns.CAA{
+		"example.com.":        {caa(0, "issue", "letsencrypt.org")},
+		"sub.example.com.":    {caa(0, "issue", "pki.goog")},
+		"example.org.":        nil,
+		"deep.a.example.net.": {caa(0, "issue", "sectigo.com")},
+	}
+	lookup := func(fqdn string) ([]*dns.CAA, error) {
+		return zone[fqdn], nil
+	}
+
+	tests := []struct {
+		hostname string
+		name     string
+		value    string
+	}{
+		{"example.com", "example.com", "letsencrypt.org"},
+		{"www.example.com", "example.com", "letsencrypt.org"},
+		{"a.b.example.com", "example.com", "letsencrypt.org"},
+		{"*.example.com", "example.com", "letsencrypt.org"},
+		{"www.sub.example.com", "sub.example.com", "pki.goog"},
+		{"*.sub.example.com", "sub.example.com", "pki.goog"},
+		{"www.example.org", "", ""},
+		{"a.example.net", "", ""},
+	}
+
+	Convey("Climbs the DNS tree to find CAA records", t, func() {
+		for _, test := range tests {
+			Convey(test.hostname, func() {
+				name, records, err := relevantCAA(test.hostname, lookup)
+				So(err, ShouldBeNil)
+				So(name, ShouldEqual, test.name)
+				if test.value == "" {
+					So(records, ShouldBeEmpty)
+				} else {
+					So(records, ShouldHaveLength, 1)
+					So(records[0].Value, ShouldEqual, test.value)
+				}
+			})
+		}
+	})
+
+	Convey("Parent records apply to a subdomain", t, func() {
+		name, records, err := relevantCAA("www.example.com", lookup)
+		So(err, ShouldBeNil)
+		So(caaRefusal("www.example.com", name, "pki.goog", "", records), ShouldContainSubstring, "example.com only allows letsencrypt.org")
+		So(caaRefusal("www.example.com", name, "letsencrypt.org", "", records), ShouldEqual, "")
+	})
+}
@@ -0,0 +1,80 @@
+package appengine
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// chainIssuers returns the issuer common name of each certificate in a DER
+// chain, starting with the leaf's.  The last one is the name of the root.
+func chainIssuers(chain [][]byte) ([]string, error) {
+	var ret []string
+	for _, der := range chain {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, cert.Issuer.CommonName)
+	}
+	return ret, nil
+}
+
+// pemChainIssuers is chainIssuers for a PEM-encoded chain.  Blocks that can't
+// be parsed are skipped.
+func pemChainIssuers(data []byte) []string {
+	var chain [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type == certificatePEMType {
+			chain = append(chain, block.Bytes)
+		}
+	}
+	ret, _ := chainIssuers(chain)
+	return ret
+}
+
+// chainHasIssuer reports whether the topmost certificate in the chain was
+// issued by the given common name.
+func chainHasIssuer(chain [][]byte, issuer string) bool {
+	issuers, err := chainIssuers(chain)
+	return err == nil && len(issuers) > 0 && strings.EqualFold(issuers[len(issuers)-1], issuer)
+}
+
+// selectChain returns the chain issued by the preferred issuer, looking through
+// the CA's alternate chains if the default one doesn't match.  The certificate
+// has already been issued by now, so the default chain is used if none match
+// or the alternates can't be fetched.
+func selectChain(c context.Context, client *acme.Client, certURL string, chain [][]byte, preferred string) [][]byte {
+	if preferred == "" || chainHasIssuer(chain, preferred) {
+		return chain
+	}
+
+	alternates, err := client.ListCertAlternates(c, certURL)
+	if err != nil {
+		log.Warningf(c, "Failed to list alternate chains, using the default: %v", err)
+		return chain
+	}
+	for _, url := range alternates {
+		alternate, err := client.FetchCert(c, url, true)
+		if err != nil {
+			log.Warningf(c, "Failed to fetch alternate chain %s: %v", url, err)
+			continue
+		}
+		if chainHasIssuer(alternate, preferred) {
+			log.Infof(c, "Using alternate chain %s issued by %s", url, preferred)
+			return alternate
+		}
+	}
+
+	log.Warningf(c, "None of the %d alternate chains are issued by %s, using the default", len(alternates), preferred)
+	return chain
+}
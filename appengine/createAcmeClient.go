@@ -2,11 +2,14 @@ package appengine
 
 import (
 	"bytes"
-	"crypto/rand"
+	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/base64"
 	"encoding/pem"
 	"fmt"
+	"net/url"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/acme"
@@ -18,26 +21,43 @@ import (
 )
 
 const (
-	letsEncryptStagingURL = "https://acme-staging.api.letsencrypt.org/directory"
+	letsEncryptStagingURL  = "https://acme-staging-v02.api.letsencrypt.org/directory"
+	zeroSSLURL             = "https://acme.zerossl.com/v2/DV90"
+	googleTrustServicesURL = "https://dv.acme-v02.api.pki.goog/directory"
+
+	// Account URLs from the ACME v1 API look like .../acme/reg/1234.
+	legacyAccountPathPrefix = "/acme/reg/"
 
 	privateKeyPEMType  = "RSA PRIVATE KEY"
 	certificatePEMType = "CERTIFICATE"
 )
 
-func createACMEClient(c context.Context) (*acme.Client, *RegisteredAccount, error) {
+// termsError is returned instead of registering a new account with a CA whose
+// Terms of Service haven't been agreed to on the account page.
+type termsError struct {
+	DirectoryURL string
+	Terms        string
+}
+
+func (e *termsError) Error() string {
+	return fmt.Sprintf("Please agree to the %s Terms of Service on the account page before registering", caName(e.DirectoryURL))
+}
+
+// createACMEClient returns a client for the given ACME directory, using the
+// account registered with that CA.  A new account is registered if there isn't
+// one already, as long as its Terms of Service have been agreed to.
+func createACMEClient(c context.Context, directoryURL string) (*acme.Client, *RegisteredAccount, error) {
+	if directoryURL == "" {
+		directoryURL = acme.LetsEncryptURL
+	}
+
 	// Get the account from Datastore.
-	entityKey := datastore.NewKey(c, registeredAccountKind, registeredAccountIDName, 0, nil)
+	entityKey := registeredAccountKey(c, directoryURL)
 	account := RegisteredAccount{}
 
 	switch err := datastore.Get(c, entityKey, &account); err {
 	case datastore.ErrNoSuchEntity:
-		log.Infof(c, "Account not found, creating new private key")
-		key, err := rsa.GenerateKey(rand.Reader, 2048)
-		if err != nil {
-			return nil, nil, fmt.Errorf("Failed to generate ACME RSA private key: %v", err)
-		}
-		account.Created = time.Now()
-		account.PrivateKey = serializeKey(key)
+		log.Infof(c, "Account for %s not found", directoryURL)
 
 	case nil:
 		log.Infof(c, "Using existing account %s", account.AccountID)
@@ -45,19 +65,98 @@ func createACMEClient(c context.Context) (*acme.Client, *RegisteredAccount, erro
 	default:
 		return nil, nil, err
 	}
+	account.DirectoryURL = directoryURL
+	if account.IsDeactivated() {
+		return nil, nil, fmt.Errorf("Account %s with %s was deactivated on %s",
+			account.AccountID, caName(directoryURL), account.Deactivated.Format("2 January 2006"))
+	}
 
+	// The account might only have an external account binding so far.
+	if !account.HasKey() {
+		key, err := generateAccountKey(c)
+		if err != nil {
+			return nil, nil, err
+		}
+		account.Created = time.Now()
+		if err := account.setKey(c, key); err != nil {
+			return nil, nil, err
+		}
+	} else if enc, err := newKeyEncrypter(c); err != nil {
+		return nil, nil, fmt.Errorf("Failed to create key encrypter: %v", err)
+	} else if account.needsSealing(enc) {
+		// Encrypt keys stored before there was a KeyEncrypter.
+		log.Infof(c, "Encrypting the key for account %s with %s", account.AccountID, enc.Name())
+		if err := account.reseal(c); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	key, err := account.signingKey(c)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Failed to load ACME account key: %v", err)
+	}
 	client := &acme.Client{
-		Key:        deserializeKey(account.PrivateKey),
-		HTTPClient: urlfetch.Client(c),
+		Key:          key,
+		HTTPClient:   urlfetch.Client(c),
+		DirectoryURL: directoryURL,
+		KID:          acme.KeyID(account.AccountID),
+	}
+
+	if strings.Contains(account.AccountID, legacyAccountPathPrefix) {
+		// Accounts registered with ACME v1 have a different URL under ACME v2.
+		// Look it up using the same key.
+		log.Infof(c, "Looking up ACME v2 URL for legacy account %s", account.AccountID)
+		acc, err := client.GetReg(c, "")
+		switch err {
+		case nil:
+			log.Infof(c, "Legacy account is now %s", acc.URI)
+			account.AccountID = acc.URI
+			client.KID = acme.KeyID(acc.URI)
+			if _, err := datastore.Put(c, entityKey, &account); err != nil {
+				return nil, nil, err
+			}
+		case acme.ErrNoAccount:
+			account.AccountID = ""
+			client.KID = ""
+		default:
+			return nil, nil, fmt.Errorf("Failed to look up legacy account: %v", err)
+		}
 	}
 
 	if account.AccountID == "" {
-		// Register with Let's Encrypt.
-		account.Email = user.Current(c).Email
+		// Register with the CA.  There's no user when failing over to another
+		// CA from a task, so the account is registered without a contact.
+		if u := user.Current(c); u != nil {
+			account.Email = u.Email
+		}
 		log.Infof(c, "Registering new account with email address %s", account.Email)
-		acc, err := client.Register(c, &acme.Account{
-			Contact: []string{fmt.Sprintf("mailto:%s", account.Email)},
-		}, acme.AcceptTOS)
+		account.Contacts = nil
+		if account.Email != "" {
+			account.Contacts = []string{fmt.Sprintf("mailto:%s", account.Email)}
+		}
+		dir, err := client.Discover(c)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Failed to get ACME directory: %v", err)
+		}
+		// Only agree to Terms of Service the admin has seen on the account
+		// page.
+		if dir.Terms != "" && dir.Terms != account.TermsAgreed {
+			return nil, nil, &termsError{directoryURL, dir.Terms}
+		}
+		acct := &acme.Account{Contact: account.Contacts}
+		if account.EABKeyID != "" {
+			log.Infof(c, "Using external account binding %s", account.EABKeyID)
+			acct.ExternalAccountBinding = &acme.ExternalAccountBinding{
+				KID: account.EABKeyID,
+				Key: account.EABHMACKey,
+			}
+		} else if dir.ExternalAccountRequired {
+			return nil, nil, fmt.Errorf("%s requires an external account binding", caName(directoryURL))
+		}
+
+		acc, err := client.Register(c, acct, func(tosURL string) bool {
+			return tosURL == account.TermsAgreed
+		})
 		if err != nil {
 			return nil, nil, fmt.Errorf("Failed to register: %v", err)
 		}
@@ -65,6 +164,7 @@ func createACMEClient(c context.Context) (*acme.Client, *RegisteredAccount, erro
 		// Put it back in datastore.
 		log.Infof(c, "Registered new account %s", acc.URI)
 		account.AccountID = acc.URI
+		client.KID = acme.KeyID(acc.URI)
 		if _, err := datastore.Put(c, entityKey, &account); err != nil {
 			return nil, nil, err
 		}
@@ -73,16 +173,90 @@ func createACMEClient(c context.Context) (*acme.Client, *RegisteredAccount, erro
 	return client, &account, nil
 }
 
-func serializeKey(key *rsa.PrivateKey) []byte {
-	return x509.MarshalPKCS1PrivateKey(key)
+// setExternalAccountBinding stores the EAB credentials to use when registering
+// with the given ACME directory.  They only take effect if there isn't a
+// registered account yet.
+func setExternalAccountBinding(c context.Context, directoryURL, keyID string, hmacKey []byte) error {
+	return datastore.RunInTransaction(c, func(c context.Context) error {
+		entityKey := registeredAccountKey(c, directoryURL)
+		account := RegisteredAccount{}
+		if err := datastore.Get(c, entityKey, &account); err != nil && err != datastore.ErrNoSuchEntity {
+			return err
+		}
+		if account.AccountID != "" {
+			return fmt.Errorf("Already registered with %s as %s", caName(directoryURL), account.AccountID)
+		}
+
+		account.DirectoryURL = directoryURL
+		account.EABKeyID = keyID
+		account.EABHMACKey = hmacKey
+		_, err := datastore.Put(c, entityKey, &account)
+		return err
+	}, nil)
+}
+
+// decodeEABKey decodes an EAB HMAC key as given out by CAs: base64url,
+// usually without padding.
+func decodeEABKey(s string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(strings.TrimSpace(s), "="))
+}
+
+// caName returns a human-readable name for an ACME directory.
+func caName(directoryURL string) string {
+	switch directoryURL {
+	case "", acme.LetsEncryptURL:
+		return "Let's Encrypt"
+	case letsEncryptStagingURL:
+		return "Let's Encrypt (staging)"
+	case zeroSSLURL:
+		return "ZeroSSL"
+	case googleTrustServicesURL:
+		return "Google Trust Services"
+	}
+	if u, err := url.Parse(directoryURL); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return directoryURL
 }
 
-func deserializeKey(key []byte) *rsa.PrivateKey {
-	ret, err := x509.ParsePKCS1PrivateKey(key)
+// generateAccountKey creates a new ACME account key of the type chosen on the
+// account page.
+func generateAccountKey(c context.Context) (crypto.Signer, error) {
+	config, err := GetConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	log.Infof(c, "Creating new %s account key", config.AccountKeyType)
+	key, err := generateCertKey(config.AccountKeyType)
 	if err != nil {
-		panic(err)
+		return nil, fmt.Errorf("Failed to generate ACME account key: %v", err)
+	}
+	return key, nil
+}
+
+// serializeKey encodes an account key for datastore.  RSA keys are stored as
+// PKCS#1 like they always have been, anything else as PKCS#8.
+func serializeKey(key crypto.Signer) ([]byte, error) {
+	if k, ok := key.(*rsa.PrivateKey); ok {
+		return x509.MarshalPKCS1PrivateKey(k), nil
+	}
+	return x509.MarshalPKCS8PrivateKey(key)
+}
+
+// deserializeKey decodes an account key stored by serializeKey.
+func deserializeKey(key []byte) (crypto.Signer, error) {
+	if ret, err := x509.ParsePKCS1PrivateKey(key); err == nil {
+		return ret, nil
+	}
+	ret, err := x509.ParsePKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := ret.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("Unsupported private key type %T", ret)
 	}
-	return ret
+	return signer, nil
 }
 
 func pemEncode(typ string, items [][]byte) ([]byte, error) {
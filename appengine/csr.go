@@ -0,0 +1,104 @@
+package appengine
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"strings"
+)
+
+var (
+	// TLS Feature extension from RFC 7633.
+	oidTLSFeature = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24}
+
+	// The status_request TLS feature, ie. OCSP must-staple.
+	tlsFeatureStatusRequest = 5
+)
+
+// CSROptions control what goes in the certificate signing request beyond the
+// hostnames.  Not every CA honours the subject attributes.
+type CSROptions struct {
+	MustStaple     bool // Add the TLS Feature extension requiring OCSP stapling.
+	OmitCommonName bool // Only list the hostnames as SANs.
+
+	Organization       string
+	OrganizationalUnit string
+	Locality           string
+	Province           string
+	Country            string
+}
+
+// Describe lists the options that differ from the defaults, for display.
+func (o CSROptions) Describe() []string {
+	var ret []string
+	if o.MustStaple {
+		ret = append(ret, "must-staple")
+	}
+	if o.OmitCommonName {
+		ret = append(ret, "no CN")
+	}
+	for _, attr := range []struct{ name, value string }{
+		{"O", o.Organization},
+		{"OU", o.OrganizationalUnit},
+		{"L", o.Locality},
+		{"ST", o.Province},
+		{"C", o.Country},
+	} {
+		if attr.value != "" {
+			ret = append(ret, attr.name+"="+attr.value)
+		}
+	}
+	return ret
+}
+
+// subject returns the CSR's subject with the given common name.
+func (o CSROptions) subject(commonName string) pkix.Name {
+	var ret pkix.Name
+	if !o.OmitCommonName {
+		ret.CommonName = commonName
+	}
+	for _, attr := range []struct {
+		field *[]string
+		value string
+	}{
+		{&ret.Organization, o.Organization},
+		{&ret.OrganizationalUnit, o.OrganizationalUnit},
+		{&ret.Locality, o.Locality},
+		{&ret.Province, o.Province},
+		{&ret.Country, o.Country},
+	} {
+		if value := strings.TrimSpace(attr.value); value != "" {
+			*attr.field = []string{value}
+		}
+	}
+	return ret
+}
+
+// createCSR creates a DER certificate signing request for the operation's
+// hostnames, signed by key.
+func createCSR(cr *CreateOperation, key crypto.Signer) ([]byte, error) {
+	asn1Subj, err := asn1.Marshal(cr.CSR.subject(cr.HostName).ToRDNSequence())
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.CertificateRequest{
+		RawSubject:         asn1Subj,
+		DNSNames:           cr.AllHostNames(),
+		SignatureAlgorithm: signatureAlgorithm(key),
+	}
+
+	if cr.CSR.MustStaple {
+		value, err := asn1.Marshal([]int{tlsFeatureStatusRequest})
+		if err != nil {
+			return nil, err
+		}
+		template.ExtraExtensions = append(template.ExtraExtensions, pkix.Extension{
+			Id:    oidTLSFeature,
+			Value: value,
+		})
+	}
+
+	return x509.CreateCertificateRequest(rand.Reader, template, key)
+}
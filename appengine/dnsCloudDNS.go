@@ -0,0 +1,127 @@
+package appengine
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+
+	dnsapi "google.golang.org/api/dns/v1"
+)
+
+// cloudDNSProvider creates TXT records in a Google Cloud DNS managed zone.
+type cloudDNSProvider struct {
+	project string
+	service *dnsapi.Service
+}
+
+func newCloudDNSProvider(c context.Context, project string) (*cloudDNSProvider, error) {
+	if project == "" {
+		project = appengine.AppID(c)
+	}
+	client, err := google.DefaultClient(c, dnsapi.NdevClouddnsReadwriteScope)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create client: %v", err)
+	}
+	service, err := dnsapi.New(client)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudDNSProvider{project: project, service: service}, nil
+}
+
+// Present adds value to the record set.  Cloud DNS rejects record sets with
+// duplicate values, which a retry or an earlier failed cleanup could leave us
+// with, so they're removed too.
+func (p *cloudDNSProvider) Present(c context.Context, fqdn, value string) error {
+	return p.update(c, fqdn, func(values []string) []string {
+		var ret []string
+		seen := map[string]struct{}{}
+		for _, v := range append(values, strconv.Quote(value)) {
+			if _, ok := seen[v]; !ok {
+				seen[v] = struct{}{}
+				ret = append(ret, v)
+			}
+		}
+		return ret
+	})
+}
+
+func (p *cloudDNSProvider) CleanUp(c context.Context, fqdn, value string) error {
+	return p.update(c, fqdn, func(values []string) []string {
+		var ret []string
+		for _, v := range values {
+			if v != strconv.Quote(value) {
+				ret = append(ret, v)
+			}
+		}
+		return ret
+	})
+}
+
+// update replaces the TXT record set at fqdn with the result of calling fn on
+// its current values.  Cloud DNS doesn't let us add or remove individual
+// records, only whole record sets.
+func (p *cloudDNSProvider) update(c context.Context, fqdn string, fn func([]string) []string) error {
+	zone, err := p.findZone(fqdn)
+	if err != nil {
+		return err
+	}
+
+	resp, err := p.service.ResourceRecordSets.List(p.project, zone).Name(fqdn).Type("TXT").Do()
+	if err != nil {
+		return fmt.Errorf("Failed to list records for %s: %v", fqdn, err)
+	}
+
+	change := &dnsapi.Change{Deletions: resp.Rrsets}
+	var existing []string
+	for _, rrset := range resp.Rrsets {
+		existing = append(existing, rrset.Rrdatas...)
+	}
+	values := fn(existing)
+	if strings.Join(values, " ") == strings.Join(existing, " ") {
+		log.Infof(c, "TXT records for %s are already up to date", fqdn)
+		return nil
+	}
+	if len(values) != 0 {
+		change.Additions = []*dnsapi.ResourceRecordSet{{
+			Name:    fqdn,
+			Type:    "TXT",
+			Ttl:     dnsChallengeTTL,
+			Rrdatas: values,
+		}}
+	}
+
+	log.Infof(c, "Updating TXT records for %s in Cloud DNS zone %s", fqdn, zone)
+	if _, err := p.service.Changes.Create(p.project, zone, change).Do(); err != nil {
+		return fmt.Errorf("Failed to update records for %s: %v", fqdn, err)
+	}
+	return nil
+}
+
+// findZone returns the name of the most specific managed zone containing
+// fqdn.
+func (p *cloudDNSProvider) findZone(fqdn string) (string, error) {
+	resp, err := p.service.ManagedZones.List(p.project).Do()
+	if err != nil {
+		return "", fmt.Errorf("Failed to list Cloud DNS zones in %s: %v", p.project, err)
+	}
+
+	var best *dnsapi.ManagedZone
+	for _, zone := range resp.ManagedZones {
+		if fqdn != zone.DnsName && !strings.HasSuffix(fqdn, "."+zone.DnsName) {
+			continue
+		}
+		if best == nil || len(zone.DnsName) > len(best.DnsName) {
+			best = zone
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("No Cloud DNS zone in %s contains %s", p.project, fqdn)
+	}
+	return best.Name, nil
+}
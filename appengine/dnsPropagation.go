@@ -0,0 +1,112 @@
+package appengine
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/socket"
+)
+
+const (
+	// Recursive resolver used to find a zone's authoritative nameservers.
+	dnsResolver = "8.8.8.8:53"
+
+	dnsTimeout = 5 * time.Second
+)
+
+// exchangeDNS sends a DNS message to the server and waits for the reply.  If
+// tsig is given it is used to sign the message.
+func exchangeDNS(c context.Context, m *dns.Msg, server string, tsig map[string]string) (*dns.Msg, error) {
+	conn, err := socket.DialTimeout(c, "udp", server, dnsTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	client := &dns.Client{TsigSecret: tsig}
+	resp, _, err := client.ExchangeWithConn(m, &dns.Conn{Conn: conn})
+	return resp, err
+}
+
+// findZone asks the server for the SOA of fqdn and returns the name of the
+// zone containing it.
+func findZone(c context.Context, server, fqdn string) (string, error) {
+	m := new(dns.Msg)
+	m.SetQuestion(fqdn, dns.TypeSOA)
+	resp, err := exchangeDNS(c, m, server, nil)
+	if err != nil {
+		return "", fmt.Errorf("SOA lookup for %s failed: %v", fqdn, err)
+	}
+	for _, rr := range append(resp.Answer, resp.Ns...) {
+		if soa, ok := rr.(*dns.SOA); ok {
+			return soa.Hdr.Name, nil
+		}
+	}
+	return "", fmt.Errorf("Couldn't find the zone containing %s", fqdn)
+}
+
+// authoritativeNameservers returns the host:port of each nameserver for the
+// zone containing fqdn.
+func authoritativeNameservers(c context.Context, fqdn string) ([]string, error) {
+	zone, err := findZone(c, dnsResolver, fqdn)
+	if err != nil {
+		return nil, err
+	}
+
+	m := new(dns.Msg)
+	m.SetQuestion(zone, dns.TypeNS)
+	resp, err := exchangeDNS(c, m, dnsResolver, nil)
+	if err != nil {
+		return nil, fmt.Errorf("NS lookup for %s failed: %v", zone, err)
+	}
+
+	var ret []string
+	for _, rr := range resp.Answer {
+		if ns, ok := rr.(*dns.NS); ok {
+			ret = append(ret, net.JoinHostPort(strings.TrimSuffix(ns.Ns, "."), "53"))
+		}
+	}
+	if len(ret) == 0 {
+		return nil, fmt.Errorf("No nameservers found for %s", zone)
+	}
+	return ret, nil
+}
+
+// checkDNSPropagation reports whether every authoritative nameserver for fqdn
+// is serving a TXT record containing value.  The CA may ask any of them, so
+// it isn't enough for the record to be visible through a recursive resolver.
+func checkDNSPropagation(c context.Context, fqdn, value string) (bool, error) {
+	nameservers, err := authoritativeNameservers(c, fqdn)
+	if err != nil {
+		return false, err
+	}
+
+	for _, ns := range nameservers {
+		m := new(dns.Msg)
+		m.SetQuestion(fqdn, dns.TypeTXT)
+		m.RecursionDesired = false
+		resp, err := exchangeDNS(c, m, ns, nil)
+		if err != nil {
+			return false, fmt.Errorf("TXT lookup for %s on %s failed: %v", fqdn, ns, err)
+		}
+		if !hasTXTRecord(resp.Answer, value) {
+			log.Infof(c, "TXT record for %s not yet present on %s", fqdn, ns)
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func hasTXTRecord(rrs []dns.RR, value string) bool {
+	for _, rr := range rrs {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,85 @@
+package appengine
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	challengeTypeHTTP = "http-01"
+	challengeTypeDNS  = "dns-01"
+
+	dnsProviderCloudDNS = "clouddns"
+	dnsProviderRFC2136  = "rfc2136"
+
+	// TTL of the TXT records we create for dns-01 challenges.
+	dnsChallengeTTL = 60
+)
+
+// DNSProvider creates and removes the TXT records used to answer dns-01
+// challenges.  fqdn is always fully qualified with a trailing dot.
+type DNSProvider interface {
+	// Present creates a TXT record at fqdn containing value.  Other TXT
+	// records at the same name are left alone.
+	Present(c context.Context, fqdn, value string) error
+
+	// CleanUp removes a TXT record previously created by Present.
+	CleanUp(c context.Context, fqdn, value string) error
+}
+
+// newDNSProvider returns the DNSProvider configured in the domain's settings.
+func newDNSProvider(c context.Context, settings *DomainSettings) (DNSProvider, error) {
+	switch settings.DNSProvider {
+	case dnsProviderCloudDNS:
+		return newCloudDNSProvider(c, settings.CloudDNSProject)
+	case dnsProviderRFC2136:
+		return newRFC2136Provider(settings)
+	default:
+		return nil, fmt.Errorf("Unknown DNS provider '%s'", settings.DNSProvider)
+	}
+}
+
+// dnsChallengeName returns the name of the TXT record for a dns-01 challenge
+// on the given hostname.
+func dnsChallengeName(hostname string) string {
+	return "_acme-challenge." + strings.TrimPrefix(hostname, "*.") + "."
+}
+
+// presentDNSRecord creates the TXT record for a dns-01 challenge on hostname
+// using the DNS provider from the domain's settings.
+func presentDNSRecord(c context.Context, settings *DomainSettings, hostname, record string) error {
+	provider, err := newDNSProvider(c, settings)
+	if err != nil {
+		return err
+	}
+	if err := provider.Present(c, dnsChallengeName(hostname), record); err != nil {
+		return fmt.Errorf("Failed to create TXT record for %s: %v", hostname, err)
+	}
+	return nil
+}
+
+// cleanupDNSRecords removes any TXT records created for the operation's dns-01
+// challenges.  A record that can't be removed is logged and left behind, so
+// the operation can still finish.
+func cleanupDNSRecords(c context.Context, cr *CreateOperation) {
+	for _, a := range cr.Authorizations {
+		if a.ChallengeType != challengeTypeDNS || a.DNSRecord == "" {
+			continue
+		}
+		settings, err := GetDomainSettings(c, a.HostName)
+		if err != nil {
+			log.Warningf(c, "Failed to get settings for %s, not removing TXT record: %v", a.HostName, err)
+			continue
+		}
+		provider, err := newDNSProvider(c, settings)
+		if err == nil {
+			err = provider.CleanUp(c, dnsChallengeName(a.HostName), a.DNSRecord)
+		}
+		if err != nil {
+			log.Warningf(c, "Failed to remove TXT record for %s: %v", a.HostName, err)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package appengine
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/miekg/dns"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// rfc2136Provider creates TXT records by sending dynamic updates (RFC 2136) to
+// a nameserver, optionally signed with TSIG.
+type rfc2136Provider struct {
+	nameserver    string
+	tsigKeyName   string
+	tsigAlgorithm string
+	tsigSecret    string
+}
+
+func newRFC2136Provider(settings *DomainSettings) (*rfc2136Provider, error) {
+	if settings.RFC2136Nameserver == "" {
+		return nil, fmt.Errorf("No nameserver configured for RFC 2136 updates")
+	}
+	p := &rfc2136Provider{
+		nameserver:    settings.RFC2136Nameserver,
+		tsigAlgorithm: settings.RFC2136TSIGAlgorithm,
+		tsigSecret:    settings.RFC2136TSIGSecret,
+	}
+	if settings.RFC2136TSIGKeyName != "" {
+		p.tsigKeyName = dns.Fqdn(settings.RFC2136TSIGKeyName)
+	}
+	if p.tsigAlgorithm == "" {
+		p.tsigAlgorithm = dns.HmacSHA256
+	}
+	return p, nil
+}
+
+func (p *rfc2136Provider) Present(c context.Context, fqdn, value string) error {
+	return p.update(c, fqdn, value, (*dns.Msg).Insert)
+}
+
+func (p *rfc2136Provider) CleanUp(c context.Context, fqdn, value string) error {
+	return p.update(c, fqdn, value, (*dns.Msg).Remove)
+}
+
+func (p *rfc2136Provider) update(c context.Context, fqdn, value string, op func(*dns.Msg, []dns.RR)) error {
+	zone, err := findZone(c, p.nameserver, fqdn)
+	if err != nil {
+		return err
+	}
+
+	rr := &dns.TXT{
+		Hdr: dns.RR_Header{Name: fqdn, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: dnsChallengeTTL},
+		Txt: []string{value},
+	}
+	m := new(dns.Msg)
+	m.SetUpdate(zone)
+	op(m, []dns.RR{rr})
+
+	var tsig map[string]string
+	if p.tsigKeyName != "" {
+		m.SetTsig(p.tsigKeyName, p.tsigAlgorithm, 300, time.Now().Unix())
+		tsig = map[string]string{p.tsigKeyName: p.tsigSecret}
+	}
+
+	log.Infof(c, "Sending DNS update for %s in zone %s to %s", fqdn, zone, p.nameserver)
+	resp, err := exchangeDNS(c, m, p.nameserver, tsig)
+	if err != nil {
+		return fmt.Errorf("DNS update for %s failed: %v", fqdn, err)
+	}
+	if resp.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("DNS update for %s was refused: %s", fqdn, dns.RcodeToString[resp.Rcode])
+	}
+	return nil
+}
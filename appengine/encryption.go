@@ -0,0 +1,329 @@
+package appengine
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+
+	kmsapi "google.golang.org/api/cloudkms/v1"
+)
+
+const (
+	// Environment variable holding a base64 AES-256 key to encrypt private keys
+	// with when there's no Cloud KMS key, eg. on the dev appserver.
+	localKeyEncryptionKeyEnv = "LOCAL_KEY_ENCRYPTION_KEY"
+	localKeyEncrypterName    = "local"
+
+	// Size of the AES-256 data encryption keys.
+	dataKeySize = 32
+)
+
+// KeyEncrypter encrypts the data encryption keys that private keys are stored
+// with (envelope encryption), so the private keys never reach datastore in
+// plain text.
+type KeyEncrypter interface {
+	// Name identifies the key encryption key.  It's saved with the encrypted
+	// data so it can be decrypted after the configured key changes.
+	Name() string
+
+	Encrypt(c context.Context, plaintext []byte) ([]byte, error)
+	Decrypt(c context.Context, ciphertext []byte) ([]byte, error)
+}
+
+// EncryptedData is data encrypted with AES-GCM using a random data key, which
+// is itself encrypted by a KeyEncrypter.
+type EncryptedData struct {
+	KeyName    string // KeyEncrypter.Name() of the key that encrypted WrappedKey.
+	WrappedKey []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+// newKeyEncrypter returns the KeyEncrypter to store private keys with: the
+// configured Cloud KMS key, or the local key on the dev appserver.  It returns
+// nil if neither is set up, in which case keys are stored unencrypted.
+func newKeyEncrypter(c context.Context) (KeyEncrypter, error) {
+	config, err := GetConfig(c)
+	if err != nil {
+		return nil, err
+	}
+	if config.KMSKeyName != "" {
+		return keyEncrypterNamed(c, config.KMSKeyName)
+	}
+	if os.Getenv(localKeyEncryptionKeyEnv) != "" {
+		return newLocalKeyEncrypter()
+	}
+	return nil, nil
+}
+
+// keyEncrypterNamed returns the KeyEncrypter with the given Name().
+func keyEncrypterNamed(c context.Context, name string) (KeyEncrypter, error) {
+	if name == localKeyEncrypterName {
+		return newLocalKeyEncrypter()
+	}
+	return newCloudKMSEncrypter(c, name)
+}
+
+// sealKey encrypts a private key with the configured KeyEncrypter.  If there
+// isn't one the key is returned as it is, to be stored unencrypted.
+func sealKey(c context.Context, key []byte) ([]byte, EncryptedData, error) {
+	enc, err := newKeyEncrypter(c)
+	if err != nil {
+		return nil, EncryptedData{}, fmt.Errorf("Failed to create key encrypter: %v", err)
+	}
+	if enc == nil {
+		return key, EncryptedData{}, nil
+	}
+	sealed, err := encryptData(c, enc, key)
+	if err != nil {
+		return nil, EncryptedData{}, fmt.Errorf("Failed to encrypt private key: %v", err)
+	}
+	return nil, sealed, nil
+}
+
+// openKey returns a private key stored by sealKey.
+func openKey(c context.Context, plain []byte, sealed *EncryptedData) ([]byte, error) {
+	if sealed.KeyName == "" {
+		return plain, nil
+	}
+	key, err := decryptData(c, sealed)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to decrypt private key: %v", err)
+	}
+	return key, nil
+}
+
+// needsSealing reports whether a private key stored by sealKey should be
+// stored again, because it's unencrypted or was encrypted with a different key
+// encryption key than enc.
+func needsSealing(enc KeyEncrypter, plain []byte, sealed *EncryptedData) bool {
+	if enc == nil {
+		return false
+	}
+	return len(plain) != 0 || (sealed.KeyName != "" && sealed.KeyName != enc.Name())
+}
+
+func encryptData(c context.Context, enc KeyEncrypter, plaintext []byte) (EncryptedData, error) {
+	dataKey := make([]byte, dataKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return EncryptedData{}, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return EncryptedData{}, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return EncryptedData{}, err
+	}
+	wrapped, err := enc.Encrypt(c, dataKey)
+	if err != nil {
+		return EncryptedData{}, err
+	}
+
+	// The key name is authenticated so the data can't be passed off as
+	// encrypted by a different key.
+	return EncryptedData{
+		KeyName:    enc.Name(),
+		WrappedKey: wrapped,
+		Nonce:      nonce,
+		Ciphertext: gcm.Seal(nil, nonce, plaintext, []byte(enc.Name())),
+	}, nil
+}
+
+func decryptData(c context.Context, d *EncryptedData) ([]byte, error) {
+	enc, err := keyEncrypterNamed(c, d.KeyName)
+	if err != nil {
+		return nil, err
+	}
+	return decryptDataWith(c, enc, d)
+}
+
+// decryptDataWith decrypts data using enc to unwrap the data key, whatever
+// d.KeyName says.
+func decryptDataWith(c context.Context, enc KeyEncrypter, d *EncryptedData) ([]byte, error) {
+	dataKey, err := enc.Decrypt(c, d.WrappedKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Open(nil, d.Nonce, d.Ciphertext, []byte(d.KeyName))
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// checkKeyEncrypter makes sure data encrypted with enc can be decrypted again,
+// before anything is stored with it.
+func checkKeyEncrypter(c context.Context, enc KeyEncrypter) error {
+	plaintext := []byte("gacertsbot")
+	ciphertext, err := enc.Encrypt(c, plaintext)
+	if err != nil {
+		return fmt.Errorf("Failed to encrypt with %s: %v", enc.Name(), err)
+	}
+	decrypted, err := enc.Decrypt(c, ciphertext)
+	if err != nil {
+		return fmt.Errorf("Failed to decrypt with %s: %v", enc.Name(), err)
+	}
+	if !bytes.Equal(decrypted, plaintext) {
+		return fmt.Errorf("%s didn't decrypt what it encrypted", enc.Name())
+	}
+	return nil
+}
+
+// sealStoredKeys encrypts any private keys in datastore that aren't encrypted
+// with the current KeyEncrypter.  Failures are logged and the rest of the keys
+// carry on.
+func sealStoredKeys(c context.Context) error {
+	enc, err := newKeyEncrypter(c)
+	if err != nil {
+		return fmt.Errorf("Failed to create key encrypter: %v", err)
+	}
+	if enc == nil {
+		return nil
+	}
+
+	var accounts []*RegisteredAccount
+	accountKeys, err := datastore.NewQuery(registeredAccountKind).GetAll(c, &accounts)
+	if err != nil {
+		return fmt.Errorf("Failed to get accounts: %v", err)
+	}
+	for i, account := range accounts {
+		if !account.needsSealing(enc) {
+			continue
+		}
+		// The Let's Encrypt account might be from before we saved the URL.
+		if account.DirectoryURL = accountKeys[i].StringID(); account.DirectoryURL == registeredAccountIDName {
+			account.DirectoryURL = acme.LetsEncryptURL
+		}
+		log.Infof(c, "Encrypting the key for account %s with %s", account.AccountID, enc.Name())
+		if err := account.reseal(c); err != nil {
+			log.Warningf(c, "Failed to encrypt the key for account %s: %v", account.AccountID, err)
+		}
+	}
+
+	var keys []*CertificateKey
+	entityKeys, err := datastore.NewQuery(certificateKeyKind).GetAll(c, &keys)
+	if err != nil {
+		return fmt.Errorf("Failed to get certificate keys: %v", err)
+	}
+	for i, key := range keys {
+		if !needsSealing(enc, key.Key, &key.Encrypted) {
+			continue
+		}
+		orderURI := entityKeys[i].StringID()
+		log.Infof(c, "Encrypting the certificate key for %s with %s", orderURI, enc.Name())
+		keyPEM, err := openKey(c, key.Key, &key.Encrypted)
+		if err == nil {
+			err = PutCertificateKey(c, orderURI, keyPEM)
+		}
+		if err != nil {
+			log.Warningf(c, "Failed to encrypt the certificate key for %s: %v", orderURI, err)
+		}
+	}
+	return nil
+}
+
+// cloudKMSEncrypter encrypts with a Cloud KMS key, named like
+// projects/*/locations/*/keyRings/*/cryptoKeys/*.
+type cloudKMSEncrypter struct {
+	name string
+	keys *kmsapi.ProjectsLocationsKeyRingsCryptoKeysService
+}
+
+func newCloudKMSEncrypter(c context.Context, name string) (*cloudKMSEncrypter, error) {
+	client, err := google.DefaultClient(c, kmsapi.CloudPlatformScope)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create client: %v", err)
+	}
+	service, err := kmsapi.New(client)
+	if err != nil {
+		return nil, err
+	}
+	return &cloudKMSEncrypter{name: name, keys: service.Projects.Locations.KeyRings.CryptoKeys}, nil
+}
+
+func (e *cloudKMSEncrypter) Name() string {
+	return e.name
+}
+
+func (e *cloudKMSEncrypter) Encrypt(c context.Context, plaintext []byte) ([]byte, error) {
+	resp, err := e.keys.Encrypt(e.name, &kmsapi.EncryptRequest{
+		Plaintext: base64.StdEncoding.EncodeToString(plaintext),
+	}).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Ciphertext)
+}
+
+func (e *cloudKMSEncrypter) Decrypt(c context.Context, ciphertext []byte) ([]byte, error) {
+	resp, err := e.keys.Decrypt(e.name, &kmsapi.DecryptRequest{
+		Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+	}).Do()
+	if err != nil {
+		return nil, err
+	}
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
+}
+
+// localKeyEncrypter encrypts with an AES-256 key from the environment, for
+// tests and the dev appserver.
+type localKeyEncrypter struct {
+	gcm cipher.AEAD
+}
+
+func newLocalKeyEncrypter() (*localKeyEncrypter, error) {
+	key, err := base64.StdEncoding.DecodeString(os.Getenv(localKeyEncryptionKeyEnv))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid %s: %v", localKeyEncryptionKeyEnv, err)
+	}
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("%s must be %d bytes, not %d", localKeyEncryptionKeyEnv, dataKeySize, len(key))
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	return &localKeyEncrypter{gcm: gcm}, nil
+}
+
+func (e *localKeyEncrypter) Name() string {
+	return localKeyEncrypterName
+}
+
+// Encrypt returns the nonce followed by the ciphertext.
+func (e *localKeyEncrypter) Encrypt(c context.Context, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, e.gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return e.gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func (e *localKeyEncrypter) Decrypt(c context.Context, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < e.gcm.NonceSize() {
+		return nil, fmt.Errorf("Ciphertext is too short")
+	}
+	nonce := ciphertext[:e.gcm.NonceSize()]
+	return e.gcm.Open(nil, nonce, ciphertext[len(nonce):], nil)
+}
@@ -1,10 +1,14 @@
 package appengine
 
 import (
+	"crypto"
+	"crypto/x509"
 	"errors"
+	"fmt"
 	"sort"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/delay"
@@ -13,62 +17,783 @@ import (
 
 const (
 	createOpKind            = "SSLCertificates-CreateOperation"
+	challengeKind           = "SSLCertificates-Challenge"
+	domainSettingsKind      = "SSLCertificates-DomainSettings"
 	registeredAccountKind   = "SSLCertificates-RegisteredAccount"
 	registeredAccountIDName = "account"
+	configKind              = "SSLCertificates-Config"
+	configIDName            = "config"
+	revocationKind          = "SSLCertificates-Revocation"
+	renewalWindowKind       = "SSLCertificates-RenewalWindow"
+	cachedAuthorizationKind = "SSLCertificates-CachedAuthorization"
+	issuanceKind            = "SSLCertificates-Issuance"
+	csrCertificateKind      = "SSLCertificates-CSRCertificate"
+	certificateKeyKind      = "SSLCertificates-CertificateKey"
+	hostNameLeaseKind       = "SSLCertificates-HostNameLease"
+	operationEventKind      = "SSLCertificates-OperationEvent"
+	uploadedCertificateKind = "SSLCertificates-UploadedCertificate"
 
 	// Operations are usually quicker than this.  If one takes longer don't show
 	// it in the UI any more and let the user start another.
-	createOperationSoftExpiry = time.Minute
+	createOperationSoftExpiry = 5 * time.Minute
 
 	// Delete operations after this time.  Errors won't show up in the UI any
 	// more.
 	createOperationHardExpiry = 24 * time.Hour
+
+	// Operations that can still be resumed are kept until their order has
+	// expired at the CA too.  Let's Encrypt's orders last a week.
+	resumableOperationExpiry = 7 * 24 * time.Hour
 )
 
+// RegisteredAccount is an account with one ACME CA.  There is one for each
+// directory URL that has been used.
 type RegisteredAccount struct {
-	Created    time.Time
-	PrivateKey []byte
-	AccountID  string
-	Email      string
+	Created time.Time
+
+	// The account key is in EncryptedPrivateKey if there's a KeyEncrypter,
+	// otherwise in PrivateKey.  Use SigningKey and setKey to access it.
+	PrivateKey          []byte
+	EncryptedPrivateKey EncryptedData
+	PublicKey           []byte // PKIX, so the key can be shown without decrypting it.
+
+	AccountID    string
+	Email        string   // Contact when the account was registered.  Superseded by Contacts.
+	Contacts     []string // eg. mailto:someone@example.com
+	DirectoryURL string
+
+	// The CA's Terms of Service URL that was last agreed to.
+	TermsAgreed     string
+	TermsAgreedDate time.Time
+
+	// Set once the account has been deactivated with the CA.  It can't be used
+	// any more.
+	Deactivated time.Time
+
+	// External account binding presented when registering, for CAs that
+	// require one.
+	EABKeyID   string
+	EABHMACKey []byte
+
+	// Keys this account used before it was rolled over to PrivateKey, oldest
+	// first.
+	PreviousKeys []PreviousAccountKey
+}
+
+// PreviousAccountKey records an account key that has been replaced.
+type PreviousAccountKey struct {
+	Fingerprint string // JWK thumbprint of the public key.
+	RolledOver  time.Time
+}
+
+// ContactAddresses returns the account's contact URLs.
+func (a *RegisteredAccount) ContactAddresses() []string {
+	if len(a.Contacts) == 0 && a.Email != "" {
+		return []string{fmt.Sprintf("mailto:%s", a.Email)}
+	}
+	return a.Contacts
+}
+
+// IsDeactivated returns whether the account has been deactivated with the CA.
+func (a *RegisteredAccount) IsDeactivated() bool {
+	return !a.Deactivated.IsZero()
+}
+
+// Put saves the account.
+func (a *RegisteredAccount) Put(c context.Context) error {
+	_, err := datastore.Put(c, registeredAccountKey(c, a.DirectoryURL), a)
+	return err
+}
+
+// GetRegisteredAccount returns the account for the given ACME directory.  An
+// empty account is returned if none has been registered yet.
+func GetRegisteredAccount(c context.Context, directoryURL string) (*RegisteredAccount, error) {
+	ret := RegisteredAccount{}
+	err := datastore.Get(c, registeredAccountKey(c, directoryURL), &ret)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	ret.DirectoryURL = directoryURL
+	return &ret, err
+}
+
+// HasKey returns whether the account has a private key yet.
+func (a *RegisteredAccount) HasKey() bool {
+	return len(a.PrivateKey) != 0 || a.EncryptedPrivateKey.KeyName != ""
+}
+
+// signingKey returns the account's private key, decrypting it if necessary.
+func (a *RegisteredAccount) signingKey(c context.Context) (crypto.Signer, error) {
+	der, err := openKey(c, a.PrivateKey, &a.EncryptedPrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return deserializeKey(der)
+}
+
+// setKey replaces the account's private key, encrypting it if there's a
+// KeyEncrypter.  The account isn't saved.
+func (a *RegisteredAccount) setKey(c context.Context, key crypto.Signer) error {
+	der, err := serializeKey(key)
+	if err != nil {
+		return fmt.Errorf("Failed to serialize account key: %v", err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(key.Public())
+	if err != nil {
+		return fmt.Errorf("Failed to serialize account public key: %v", err)
+	}
+	plain, sealed, err := sealKey(c, der)
+	if err != nil {
+		return err
+	}
+	a.PrivateKey = plain
+	a.EncryptedPrivateKey = sealed
+	a.PublicKey = pub
+	return nil
+}
+
+// needsSealing reports whether the account's key should be encrypted again
+// with enc.
+func (a *RegisteredAccount) needsSealing(enc KeyEncrypter) bool {
+	return needsSealing(enc, a.PrivateKey, &a.EncryptedPrivateKey)
+}
+
+// reseal stores the account's key again with the current KeyEncrypter and
+// saves the account.
+func (a *RegisteredAccount) reseal(c context.Context) error {
+	key, err := a.signingKey(c)
+	if err != nil {
+		return err
+	}
+	if err := a.setKey(c, key); err != nil {
+		return err
+	}
+	return a.Put(c)
+}
+
+// publicKey returns the public half of the account's key, or nil if it
+// doesn't have one.
+func (a *RegisteredAccount) publicKey() crypto.PublicKey {
+	if len(a.PublicKey) != 0 {
+		if pub, err := x509.ParsePKIXPublicKey(a.PublicKey); err == nil {
+			return pub
+		}
+	}
+	// Unencrypted keys stored before we kept the public key.
+	if key, err := deserializeKey(a.PrivateKey); err == nil {
+		return key.Public()
+	}
+	return nil
+}
+
+// KeyFingerprint returns the JWK thumbprint of the account's current key.
+func (a *RegisteredAccount) KeyFingerprint() string {
+	pub := a.publicKey()
+	if pub == nil {
+		return ""
+	}
+	fingerprint, err := acme.JWKThumbprint(pub)
+	if err != nil {
+		return ""
+	}
+	return fingerprint
+}
+
+// KeyAlgorithm describes the account's current key, eg. "ECDSA P-256".
+func (a *RegisteredAccount) KeyAlgorithm() string {
+	pub := a.publicKey()
+	if pub == nil {
+		return ""
+	}
+	return keyAlgorithm(pub)
+}
+
+// IsEncrypted returns whether the account's key is encrypted at rest.
+func (a *RegisteredAccount) IsEncrypted() bool {
+	return a.EncryptedPrivateKey.KeyName != ""
+}
+
+// registeredAccountKey returns the datastore key of the account for the given
+// ACME directory.  The Let's Encrypt account keeps the key it had before other
+// CAs were supported.
+func registeredAccountKey(c context.Context, directoryURL string) *datastore.Key {
+	if directoryURL == acme.LetsEncryptURL {
+		return datastore.NewKey(c, registeredAccountKind, registeredAccountIDName, 0, nil)
+	}
+	return datastore.NewKey(c, registeredAccountKind, directoryURL, 0, nil)
+}
+
+// Config holds the settings that apply to the whole deployment.
+type Config struct {
+	DirectoryURL string // ACME directory of the CA to get new certificates from.
+
+	// Other CAs to try, in order, when DirectoryURL fails or rate limits us.
+	FallbackDirectoryURLs []string
+
+	// How many certificates to get from each CA per week, for each registered
+	// domain and for each exact set of hostnames.  These should be at or below
+	// the CA's rate limits.
+	CertsPerDomainBudget int
+	DuplicateCertBudget  int
+
+	// Common name of the root the certificate chain should lead to, if the CA
+	// offers a choice.  Empty uses the CA's default chain.
+	PreferredChain string
+
+	// Type of key to generate for new ACME accounts and key rollovers, see
+	// generateCertKey.
+	AccountKeyType string
+
+	// Cloud KMS key to encrypt stored private keys with, eg.
+	// projects/*/locations/*/keyRings/*/cryptoKeys/*.
+	KMSKeyName string
+}
+
+// DirectoryURLs returns every configured CA in the order they should be tried.
+func (cfg *Config) DirectoryURLs() []string {
+	return append([]string{cfg.DirectoryURL}, cfg.FallbackDirectoryURLs...)
+}
+
+func (cfg *Config) Put(c context.Context) error {
+	_, err := datastore.Put(c, datastore.NewKey(c, configKind, configIDName, 0, nil), cfg)
+	return err
+}
+
+// GetConfig returns the deployment's settings, or the defaults if none have
+// been saved.
+func GetConfig(c context.Context) (*Config, error) {
+	ret := Config{
+		DirectoryURL:         acme.LetsEncryptURL,
+		CertsPerDomainBudget: defaultCertsPerDomainBudget,
+		DuplicateCertBudget:  defaultDuplicateCertBudget,
+		AccountKeyType:       keyTypeRSA2048,
+	}
+	err := datastore.Get(c, datastore.NewKey(c, configKind, configIDName, 0, nil), &ret)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return &ret, err
+}
+
+// Authorization is one of the identifier authorizations belonging to an ACME
+// order.
+type Authorization struct {
+	URI           string // ACME Authorization URL.
+	HostName      string // The hostname being authorized, including any "*.".
+	ChallengeURI  string // ACME Challenge URL, empty if already valid.
+	ChallengeType string // http-01 or dns-01.
+	Token         string // Challenge token.
+	DNSRecord     string // TXT record value for dns-01 challenges.
 }
 
 type CreateOperation struct {
 	// Key is provided by Get* functions, but ignored otherwise.
 	Key *datastore.Key `datastore:"-"`
 
-	HostName         string // The hostname we're creating a certificate for.
-	AuthorizationURI string // ACME Authorization ID.
-	ChallengeURI     string // ACME Challenge ID.
-	Token            string // Challenge token.
-	Response         string // Challenge response.
+	HostName       string          // The primary hostname, used as the certificate's common name.
+	HostNames      []string        // Every hostname the certificate covers, including HostName.
+	DirectoryURL   string          // ACME directory of the CA issuing the certificate.
+	FailedOver     []string        // ACME directories that failed before DirectoryURL was tried.
+	OrderURI       string          // ACME Order URL.
+	FinalizeURI    string          // ACME Order finalize URL.
+	CertificateURI string          // ACME Certificate URL, set once finalized.
+	ChainIssuers   []string        // Issuer of each certificate in the chain, from the leaf up.
+	Authorizations []Authorization // Authorizations required by the order.
+	KeyType        string          // Type of private key to generate, see generateCertKey.
+	Profile        string          // CA certificate profile, empty for the default.
+	ValidityDays   int             // Requested lifetime, zero for the CA's default.
+	CSR            CSROptions      // Extra certificate signing request options.
+	ProvidedCSR    []byte          // DER CSR to use instead of generating a key.
+
+	// The step the operation is waiting to run, see operationSteps.  The
+	// driver task saves the operation after every step, so it can be resumed
+	// from here.
+	State         string
+	Chain         []byte `datastore:",noindex"` // PEM certificate chain, once issued.
+	CertificateID string // App Engine ID of the uploaded certificate.
+	LeaseID       string // Holder of the hostnames' leases, see acquireHostNameLeases.
 
-	Accepted  time.Time // Time we accepted the challenge.
-	Responded time.Time // Time we responded to the challenge.
+	Accepted  time.Time // Time we created the order and accepted the challenges.
+	Responded time.Time // Only set by old versions, see LastResponded.
+	Finalized time.Time // Time we submitted the CSR to finalize the order.
 	Issued    time.Time // Time we were issued a certificate.
 	Uploaded  time.Time // Time we upload the certificate to appengine.
 	Mapped    time.Time // Time we made the certificate the default on the domain.
+	Updated   time.Time // Time the driver task last ran a step.
 
 	Error               string
+	Failure             OperationError // Structured version of Error.
 	MappedCertificateID string
 	IsFinished          bool
 }
 
+// Challenge is a pending http-01 challenge response, keyed by its token so it
+// can be found quickly when the CA comes to validate it.
+type Challenge struct {
+	OrderURI  string // The CreateOperation this challenge belongs to.
+	Response  string // Challenge response.
+	Created   time.Time
+	Responded time.Time // Time we last responded to the CA.
+}
+
+// DomainSettings holds the per-domain options for getting certificates.  A
+// domain without any saved settings uses http-01 challenges.
+type DomainSettings struct {
+	ChallengeType string // http-01 or dns-01.
+	DNSProvider   string // Where to create dns-01 TXT records, see newDNSProvider.
+	KeyType       string // Certificate private key type, see generateCertKey.
+
+	// The CA's certificate profile to ask for, eg. shortlived.  Empty uses the
+	// CA's default.
+	Profile string
+
+	// How long the certificate should be valid for, for CAs that let the order
+	// choose.  Zero uses the CA's default.
+	ValidityDays int
+
+	CSR CSROptions
+
+	CloudDNSProject string // Project owning the Cloud DNS zone, defaults to this app.
+
+	RFC2136Nameserver    string // host:port of the nameserver accepting updates.
+	RFC2136TSIGKeyName   string
+	RFC2136TSIGAlgorithm string
+	RFC2136TSIGSecret    string // Base64-encoded.
+}
+
+func (s *DomainSettings) Put(c context.Context, hostname string) error {
+	_, err := datastore.Put(c, datastore.NewKey(c, domainSettingsKind, hostname, 0, nil), s)
+	return err
+}
+
+// GetDomainSettings returns the settings for the given domain, or the defaults
+// if none have been saved.
+func GetDomainSettings(c context.Context, hostname string) (*DomainSettings, error) {
+	ret := DomainSettings{ChallengeType: challengeTypeHTTP, KeyType: defaultKeyType}
+	err := datastore.Get(c, datastore.NewKey(c, domainSettingsKind, hostname, 0, nil), &ret)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return &ret, err
+}
+
+// Put saves the operation keyed by its order URL.  Operations refused before
+// an order was created are given a new ID.
 func (cr *CreateOperation) Put(c context.Context) error {
-	_, err := datastore.Put(c, datastore.NewKey(c, createOpKind, cr.Token, 0, nil), cr)
+	_, err := datastore.Put(c, datastore.NewKey(c, createOpKind, cr.OrderURI, 0, nil), cr)
 	return err
 }
 
+// AllHostNames returns every hostname the operation is getting a certificate
+// for.  Operations created before multi-domain certificates only have
+// HostName.
+func (cr *CreateOperation) AllHostNames() []string {
+	if len(cr.HostNames) == 0 {
+		return []string{cr.HostName}
+	}
+	return cr.HostNames
+}
+
+// CAName returns the name of the CA issuing the certificate.
+func (cr *CreateOperation) CAName() string {
+	return caName(cr.DirectoryURL)
+}
+
+// FailedOverCANames returns the names of the CAs that were tried before this
+// one.
+func (cr *CreateOperation) FailedOverCANames() []string {
+	var ret []string
+	for _, directoryURL := range cr.FailedOver {
+		ret = append(ret, caName(directoryURL))
+	}
+	return ret
+}
+
 func (cr *CreateOperation) IsOngoing() bool {
-	return cr != nil && !cr.IsFinished && !time.Now().After(cr.Accepted.Add(createOperationSoftExpiry))
+	return cr != nil && !cr.IsFinished && !time.Now().After(cr.lastActive().Add(createOperationSoftExpiry))
+}
+
+// lastActive returns when the operation was started or last advanced.
+func (cr *CreateOperation) lastActive() time.Time {
+	if cr.Updated.After(cr.Accepted) {
+		return cr.Updated
+	}
+	return cr.Accepted
+}
+
+// isExpired reports whether the operation can be deleted: it hasn't changed
+// for createOperationHardExpiry, and it's done, or it failed before an order
+// was created, or its order has expired.
+func (cr *CreateOperation) isExpired(now time.Time) bool {
+	expiry := createOperationHardExpiry
+	if _, ok := operationSteps[cr.State]; ok && cr.OrderURI != "" {
+		expiry = resumableOperationExpiry
+	}
+	return now.After(cr.lastActive().Add(expiry))
+}
+
+// IsResumable reports whether the operation gave up partway through and can
+// be resumed from the step it failed at.
+func (cr *CreateOperation) IsResumable() bool {
+	_, ok := operationSteps[cr.State]
+	return cr.IsFinished && cr.OrderURI != "" && ok
 }
 
-func GetCreateOperation(c context.Context, token string) (*CreateOperation, error) {
+func GetCreateOperation(c context.Context, orderURI string) (*CreateOperation, error) {
 	var ret CreateOperation
-	ret.Key = datastore.NewKey(c, createOpKind, token, 0, nil)
+	ret.Key = datastore.NewKey(c, createOpKind, orderURI, 0, nil)
 	err := datastore.Get(c, ret.Key, &ret)
 	return &ret, err
 }
 
+// OperationEvent is an entry in a CreateOperation's event log, stored as a
+// child of the operation.
+type OperationEvent struct {
+	Time       time.Time
+	Type       string // See event*.
+	Step       string // State the operation was in.
+	NextStep   string // State the operation moved to, for finish events.
+	Error      string `datastore:",noindex"`
+	RetryCount int    // How many times the task had been retried.
+	TaskName   string
+}
+
+// Put saves the event as a child of the operation.  Operations refused before
+// an order was created don't have a log.
+func (ev *OperationEvent) Put(c context.Context, cr *CreateOperation) error {
+	if cr.OrderURI == "" {
+		return nil
+	}
+	parent := datastore.NewKey(c, createOpKind, cr.OrderURI, 0, nil)
+	_, err := datastore.Put(c, datastore.NewIncompleteKey(c, operationEventKind, parent), ev)
+	return err
+}
+
+// GetOperationEvents returns the operation's event log, oldest first.  It
+// deliberately does not use a datastore index.
+func GetOperationEvents(c context.Context, orderURI string) ([]*OperationEvent, error) {
+	var ret []*OperationEvent
+	parent := datastore.NewKey(c, createOpKind, orderURI, 0, nil)
+	if _, err := datastore.NewQuery(operationEventKind).Ancestor(parent).GetAll(c, &ret); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ret, func(i, j int) bool { return ret[i].Time.Before(ret[j].Time) })
+	return ret, nil
+}
+
+// HostNameLease stops more than one operation getting a certificate for a
+// hostname at once.  Keyed by hostname, see acquireHostNameLeases.
+type HostNameLease struct {
+	Holder   string // LeaseID of the operation holding the lease.
+	Acquired time.Time
+	Expires  time.Time
+}
+
+func hostNameLeaseKey(c context.Context, hostname string) *datastore.Key {
+	return datastore.NewKey(c, hostNameLeaseKind, hostname, 0, nil)
+}
+
+// CertificateKey is the private key for an operation's certificate, keyed by
+// the operation's order URL.  It's kept out of the CreateOperation so it's
+// only loaded by the steps that need it, and deleted once App Engine has it.
+type CertificateKey struct {
+	Key       []byte `datastore:",noindex"` // PEM, if there's no KeyEncrypter.
+	Encrypted EncryptedData
+	Created   time.Time
+}
+
+func certificateKeyKey(c context.Context, orderURI string) *datastore.Key {
+	return datastore.NewKey(c, certificateKeyKind, orderURI, 0, nil)
+}
+
+// PutCertificateKey saves the private key, encrypted if there's a
+// KeyEncrypter.
+func PutCertificateKey(c context.Context, orderURI string, key privateKeyPEM) error {
+	plain, sealed, err := sealKey(c, key)
+	if err != nil {
+		return err
+	}
+	_, err = datastore.Put(c, certificateKeyKey(c, orderURI), &CertificateKey{
+		Key:       plain,
+		Encrypted: sealed,
+		Created:   time.Now(),
+	})
+	return err
+}
+
+func GetCertificateKey(c context.Context, orderURI string) (privateKeyPEM, error) {
+	var ret CertificateKey
+	if err := datastore.Get(c, certificateKeyKey(c, orderURI), &ret); err != nil {
+		return nil, err
+	}
+	key, err := openKey(c, ret.Key, &ret.Encrypted)
+	return privateKeyPEM(key), err
+}
+
+func DeleteCertificateKey(c context.Context, orderURI string) error {
+	err := datastore.Delete(c, certificateKeyKey(c, orderURI))
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return err
+}
+
+func PutChallenge(c context.Context, token string, ch *Challenge) error {
+	_, err := datastore.Put(c, datastore.NewKey(c, challengeKind, token, 0, nil), ch)
+	return err
+}
+
+func GetChallenge(c context.Context, token string) (*Challenge, error) {
+	var ret Challenge
+	err := datastore.Get(c, datastore.NewKey(c, challengeKind, token, 0, nil), &ret)
+	return &ret, err
+}
+
+// LastResponded returns when we last responded to one of the operation's
+// http-01 challenges, or the zero time if we haven't.
+func LastResponded(c context.Context, cr *CreateOperation) (time.Time, error) {
+	var challenges []*Challenge
+	if _, err := datastore.NewQuery(challengeKind).Filter("OrderURI =", cr.OrderURI).GetAll(c, &challenges); err != nil {
+		return time.Time{}, err
+	}
+	ret := cr.Responded
+	for _, ch := range challenges {
+		if ch.Responded.After(ret) {
+			ret = ch.Responded
+		}
+	}
+	return ret, nil
+}
+
+// Revocation records a certificate that was revoked with the CA.  It's keyed
+// by the certificate's serial number.
+type Revocation struct {
+	CertificateID string // App Engine certificate ID.
+	DomainNames   []string
+	SerialNumber  string // Hex.
+	Issuer        string
+	DirectoryURL  string
+	Reason        string // unspecified, keyCompromise or superseded.
+	SignedWith    string // account or certificate.
+	Revoked       time.Time
+}
+
+func (rev *Revocation) Put(c context.Context) error {
+	_, err := datastore.Put(c, datastore.NewKey(c, revocationKind, rev.SerialNumber, 0, nil), rev)
+	return err
+}
+
+// CAName returns the name of the CA the certificate was revoked with.
+func (rev *Revocation) CAName() string {
+	return caName(rev.DirectoryURL)
+}
+
+// GetRevocations returns every revoked certificate, most recent first.
+func GetRevocations(c context.Context) ([]*Revocation, error) {
+	var ret []*Revocation
+	_, err := datastore.NewQuery(revocationKind).GetAll(c, &ret)
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Revoked.After(ret[j].Revoked)
+	})
+	return ret, err
+}
+
+// RenewalWindow is when the CA suggested renewing a domain's certificate,
+// from its ACME Renewal Information endpoint.  It's keyed by hostname.
+type RenewalWindow struct {
+	CertificateID  string // App Engine certificate ID the window applies to.
+	Start          time.Time
+	End            time.Time
+	RenewAt        time.Time // Picked at random within the window.
+	ExplanationURL string
+	Checked        time.Time
+	NextCheck      time.Time // Don't ask the CA again before this.
+}
+
+func (rw *RenewalWindow) Put(c context.Context, hostname string) error {
+	_, err := datastore.Put(c, datastore.NewKey(c, renewalWindowKind, hostname, 0, nil), rw)
+	return err
+}
+
+// GetRenewalWindow returns the domain's renewal window, or an empty one if the
+// CA hasn't been asked yet.
+func GetRenewalWindow(c context.Context, hostname string) (*RenewalWindow, error) {
+	var ret RenewalWindow
+	err := datastore.Get(c, datastore.NewKey(c, renewalWindowKind, hostname, 0, nil), &ret)
+	if err == datastore.ErrNoSuchEntity {
+		err = nil
+	}
+	return &ret, err
+}
+
+// GetAllRenewalWindows returns every domain's renewal window keyed by hostname.
+func GetAllRenewalWindows(c context.Context) (map[string]*RenewalWindow, error) {
+	var windows []*RenewalWindow
+	keys, err := datastore.NewQuery(renewalWindowKind).GetAll(c, &windows)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]*RenewalWindow{}
+	for i, key := range keys {
+		ret[key.StringID()] = windows[i]
+	}
+	return ret, nil
+}
+
+// CachedAuthorization is a valid authorization the CA gave an account for an
+// identifier.  It's keyed by the authorization URL.
+type CachedAuthorization struct {
+	HostName     string // Including any "*.".
+	DirectoryURL string
+	AccountID    string
+	URI          string // ACME Authorization URL.
+	Expires      time.Time
+}
+
+func (ca *CachedAuthorization) Put(c context.Context) error {
+	_, err := datastore.Put(c, datastore.NewKey(c, cachedAuthorizationKind, ca.URI, 0, nil), ca)
+	return err
+}
+
+// GetCachedAuthorizations returns the account's authorizations that haven't
+// expired yet, keyed by URL.
+func GetCachedAuthorizations(c context.Context, directoryURL, accountID string) (map[string]*CachedAuthorization, error) {
+	var all []*CachedAuthorization
+	if _, err := datastore.NewQuery(cachedAuthorizationKind).GetAll(c, &all); err != nil {
+		return nil, err
+	}
+	ret := map[string]*CachedAuthorization{}
+	now := time.Now()
+	for _, auth := range all {
+		if auth.DirectoryURL == directoryURL && auth.AccountID == accountID && auth.Expires.After(now) {
+			ret[auth.URI] = auth
+		}
+	}
+	return ret, nil
+}
+
+// Issuance records a certificate we got from a CA, for keeping within its rate
+// limits.
+type Issuance struct {
+	DirectoryURL      string
+	HostNames         []string
+	RegisteredDomains []string // eg. example.co.uk for www.example.co.uk.
+	Issued            time.Time
+}
+
+func (iss *Issuance) Put(c context.Context) error {
+	_, err := datastore.Put(c, datastore.NewIncompleteKey(c, issuanceKind, nil), iss)
+	return err
+}
+
+// GetIssuancesSince returns the certificates the CA issued since the given
+// time.
+func GetIssuancesSince(c context.Context, directoryURL string, since time.Time) ([]*Issuance, error) {
+	var all []*Issuance
+	if _, err := datastore.NewQuery(issuanceKind).Filter("Issued >", since).GetAll(c, &all); err != nil {
+		return nil, err
+	}
+	var ret []*Issuance
+	for _, iss := range all {
+		if iss.DirectoryURL == directoryURL {
+			ret = append(ret, iss)
+		}
+	}
+	return ret, nil
+}
+
+// UploadedCertificate records which CA issued a certificate we uploaded to App
+// Engine, so it can be renewed and revoked with the same CA long after its
+// operation is deleted.  It's keyed by App Engine certificate ID.
+type UploadedCertificate struct {
+	HostNames    []string
+	DirectoryURL string
+	OrderURI     string
+	Expiry       time.Time
+}
+
+func (uc *UploadedCertificate) Put(c context.Context, certID string) error {
+	_, err := datastore.Put(c, datastore.NewKey(c, uploadedCertificateKind, certID, 0, nil), uc)
+	return err
+}
+
+// GetUploadedCertificate returns the record of an uploaded certificate, or
+// datastore.ErrNoSuchEntity if it was uploaded before we kept them.
+func GetUploadedCertificate(c context.Context, certID string) (*UploadedCertificate, error) {
+	var ret UploadedCertificate
+	err := datastore.Get(c, datastore.NewKey(c, uploadedCertificateKind, certID, 0, nil), &ret)
+	return &ret, err
+}
+
+// GetAllUploadedCertificates returns every uploaded certificate we have a
+// record of, keyed by App Engine certificate ID.
+func GetAllUploadedCertificates(c context.Context) (map[string]*UploadedCertificate, error) {
+	var all []*UploadedCertificate
+	keys, err := datastore.NewQuery(uploadedCertificateKind).GetAll(c, &all)
+	if err != nil {
+		return nil, err
+	}
+	ret := map[string]*UploadedCertificate{}
+	for i, key := range keys {
+		ret[key.StringID()] = all[i]
+	}
+	return ret, nil
+}
+
+// DeleteUploadedCertificate forgets an uploaded certificate.
+func DeleteUploadedCertificate(c context.Context, certID string) error {
+	err := datastore.Delete(c, datastore.NewKey(c, uploadedCertificateKind, certID, 0, nil))
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+// CSRCertificate is a certificate issued for a CSR we were given.  We never
+// see its private key so it can't be uploaded to App Engine.  It's keyed by
+// order URL.
+type CSRCertificate struct {
+	HostNames    []string
+	DirectoryURL string
+	OrderURI     string
+	Chain        []byte // PEM encoded, leaf first.
+	Issued       time.Time
+	Expiry       time.Time
+}
+
+func (cc *CSRCertificate) Put(c context.Context) error {
+	_, err := datastore.Put(c, datastore.NewKey(c, csrCertificateKind, cc.OrderURI, 0, nil), cc)
+	return err
+}
+
+// CAName returns the name of the CA that issued the certificate.
+func (cc *CSRCertificate) CAName() string {
+	return caName(cc.DirectoryURL)
+}
+
+func GetCSRCertificate(c context.Context, orderURI string) (*CSRCertificate, error) {
+	var ret CSRCertificate
+	err := datastore.Get(c, datastore.NewKey(c, csrCertificateKind, orderURI, 0, nil), &ret)
+	return &ret, err
+}
+
+// GetCSRCertificates returns the certificates issued for CSRs that haven't
+// expired, most recent first.
+func GetCSRCertificates(c context.Context) ([]*CSRCertificate, error) {
+	var all []*CSRCertificate
+	if _, err := datastore.NewQuery(csrCertificateKind).GetAll(c, &all); err != nil {
+		return nil, err
+	}
+	var ret []*CSRCertificate
+	for _, cc := range all {
+		if cc.Expiry.After(time.Now()) {
+			ret = append(ret, cc)
+		}
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Issued.After(ret[j].Issued) })
+	return ret, nil
+}
+
 func GetAllCreateOperations(c context.Context) ([]*CreateOperation, error) {
 	var ret []*CreateOperation
 	keys, err := datastore.NewQuery(createOpKind).GetAll(c, &ret)
@@ -93,7 +818,9 @@ func GetRecentCreateOperations(c context.Context) (map[string]*CreateOperation,
 
 	ret := map[string]*CreateOperation{}
 	for _, op := range all {
-		ret[op.HostName] = op
+		for _, hostname := range op.AllHostNames() {
+			ret[hostname] = op
+		}
 	}
 	return ret, nil
 }
@@ -104,21 +831,43 @@ var (
 
 // updateOperation runs the given function and afterwards updates the
 // CreateOperation in datastore.  It sets IsFinished if the function returned
-// operationFinished, or if it returned an error on its last retry.
+// operationFinished, or if it returned an error on its last retry, and then
+// releases the operation's hostname leases.  If the CA rate limited us or kept
+// failing before issuing a certificate, the operation is restarted with the
+// next CA instead.
 func updateOperation(c context.Context, cr *CreateOperation, fn func() error) error {
 	err := fn()
+	cr.Updated = time.Now()
+	failedOver := false
 	switch {
 	case err == operationFinished:
 		cr.IsFinished = true
 		err = nil
 
 	case err != nil:
-		cr.Error = err.Error()
+		cr.setError(err)
 
 		// Will we be retried again?
 		headers, _ := delay.RequestHeaders(c)
+		lastRetry := headers.TaskRetryCount == taskRetryLimit
 
-		if headers.TaskRetryCount == taskRetryLimit {
+		if (lastRetry || isRateLimited(err)) && cr.Issued.IsZero() {
+			next, ferr := failover(c, cr)
+			if ferr != nil {
+				log.Errorf(c, "Failed to fail over to another CA: %v", ferr)
+			} else if next != "" {
+				log.Infof(c, "Giving up on %s, trying %s instead", cr.DirectoryURL, next)
+				cr.Error = fmt.Sprintf("%s - trying %s instead", cr.Error, caName(next))
+				recordEvent(c, cr, OperationEvent{Type: eventFailover, Error: cr.Error})
+				cr.State = stateFailed
+				cr.IsFinished = true
+				failedOver = true
+				err = nil
+				break
+			}
+		}
+
+		if lastRetry {
 			log.Infof(c, "This was the last retry, marking operation as finished")
 			cr.IsFinished = true
 		} else {
@@ -126,5 +875,16 @@ func updateOperation(c context.Context, cr *CreateOperation, fn func() error) er
 		}
 	}
 	cr.Put(c)
-	return err
+
+	// Let other operations have the hostnames.  The next CA's operation takes
+	// over the leases after a failover.
+	if cr.IsFinished && !failedOver && cr.LeaseID != "" {
+		releaseHostNameLeases(c, cr.AllHostNames(), cr.LeaseID)
+	}
+
+	if err != nil {
+		// The delay package logs the error, so return the redacted one.
+		return errors.New(cr.Error)
+	}
+	return nil
 }
@@ -0,0 +1,38 @@
+package appengine
+
+import (
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+// Types of OperationEvent.
+const (
+	eventCreated  = "created"  // The order was created.
+	eventStart    = "start"    // A step started.
+	eventFinish   = "finish"   // A step finished and the operation moved on.
+	eventError    = "error"    // A step failed.
+	eventFailover = "failover" // The operation was restarted with another CA.
+	eventResume   = "resume"   // A stopped operation was resumed.
+)
+
+// recordEvent adds an event to the operation's log, filling in the time and
+// the task it happened in.  The log is only for showing on the operation page,
+// so an event that can't be saved is logged and left out of it.
+func recordEvent(c context.Context, cr *CreateOperation, ev OperationEvent) {
+	ev.Time = time.Now()
+	if ev.Step == "" {
+		ev.Step = cr.State
+	}
+	// There are no task headers outside a task, eg. when resuming from the
+	// status page.
+	if headers, err := delay.RequestHeaders(c); err == nil {
+		ev.RetryCount = int(headers.TaskRetryCount)
+		ev.TaskName = headers.TaskName
+	}
+	if err := ev.Put(c, cr); err != nil {
+		log.Warningf(c, "Failed to record %s event for %s: %v", ev.Type, cr.HostName, err)
+	}
+}
@@ -0,0 +1,71 @@
+package appengine
+
+import (
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/delay"
+)
+
+// isRateLimited reports whether err, or any error it wraps, is an ACME
+// rateLimited problem.
+func isRateLimited(err error) bool {
+	var acmeErr *acme.Error
+	if !errors.As(err, &acmeErr) {
+		return false
+	}
+	_, ok := acme.RateLimit(acmeErr)
+	return ok
+}
+
+// nextDirectoryURL returns the first configured CA that isn't in failed, or ""
+// if they've all been tried.
+func nextDirectoryURL(config *Config, failed []string) string {
+	for _, directoryURL := range config.DirectoryURLs() {
+		if !containsString(failed, directoryURL) {
+			return directoryURL
+		}
+	}
+	return ""
+}
+
+// failover restarts the operation's order with the next configured CA and
+// returns its directory URL, or "" if there are no more CAs to try.
+func failover(c context.Context, cr *CreateOperation) (string, error) {
+	config, err := GetConfig(c)
+	if err != nil {
+		return "", fmt.Errorf("Failed to get config: %v", err)
+	}
+
+	failed := append(append([]string{}, cr.FailedOver...), cr.DirectoryURL)
+	next := nextDirectoryURL(config, failed)
+	if next == "" {
+		return "", nil
+	}
+	if err := delayFunc(c, failoverFunc, cr.AllHostNames(), cr.ProvidedCSR, failed, cr.LeaseID); err != nil {
+		return "", err
+	}
+
+	// The new order gets its own challenges.
+	cleanupDNSRecords(c, cr)
+	return next, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// failoverFunc is set in init because createOrder indirectly refers to it
+// through updateOperation.
+var failoverFunc *delay.Function
+
+func init() {
+	failoverFunc = delay.Func("failover", createOrder)
+}
@@ -0,0 +1,286 @@
+package appengine
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/flosch/pongo2"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
+)
+
+var (
+	tplAccount = loadTemplate("account.html")
+)
+
+func handleAccount(c context.Context, w http.ResponseWriter, r *http.Request) error {
+	config, err := GetConfig(c)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "POST" {
+		if err := doAccountAction(c, config.DirectoryURL, r); err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/ssl-certificates/account", http.StatusFound)
+		return nil
+	}
+
+	account, err := GetRegisteredAccount(c, config.DirectoryURL)
+	if err != nil {
+		return err
+	}
+
+	// Ask the CA for its current Terms of Service and what it knows about the
+	// account.  Show any errors on the page rather than failing.
+	var dir acme.Directory
+	var reg *acme.Account
+	var caErr error
+	if !account.IsDeactivated() {
+		var client *acme.Client
+		var registered *RegisteredAccount
+		client, registered, caErr = createACMEClient(c, config.DirectoryURL)
+		var termsErr *termsError
+		if errors.As(caErr, &termsErr) {
+			// Show the terms to agree to before registering.
+			dir.Terms = termsErr.Terms
+			caErr = nil
+		} else if caErr == nil {
+			account = registered
+			dir, caErr = client.Discover(c)
+			if caErr == nil {
+				reg, caErr = client.GetReg(c, "")
+			}
+		}
+		if caErr != nil {
+			log.Errorf(c, "Failed to get ACME account: %v", caErr)
+		}
+	}
+
+	return tplAccount.ExecuteWriter(pongo2.Context{
+		"project":      appengine.AppID(c),
+		"caName":       caName(config.DirectoryURL),
+		"directoryURL": config.DirectoryURL,
+		"account":      account,
+		"reg":          reg,
+		"terms":        dir.Terms,
+		"termsChanged": dir.Terms != "" && dir.Terms != account.TermsAgreed,
+		"keyType":      config.AccountKeyType,
+		"kmsKeyName":   config.KMSKeyName,
+		"error":        caErr,
+	}, w)
+}
+
+// doAccountAction makes the change to the account requested by the form.
+func doAccountAction(c context.Context, directoryURL string, r *http.Request) error {
+	action := r.FormValue("action")
+	switch action {
+	case "import":
+		return importAccount(c, directoryURL, r.FormValue("accountURL"),
+			[]byte(r.FormValue("key")), r.FormValue("replace") != "")
+
+	case "key-type":
+		// Only used for new accounts and key rollovers.
+		keyType := r.FormValue("keyType")
+		if keyType != keyTypeRSA2048 && keyType != keyTypeECDSAP256 {
+			return fmt.Errorf("Unsupported account key type '%s'", keyType)
+		}
+		config, err := GetConfig(c)
+		if err != nil {
+			return err
+		}
+		config.AccountKeyType = keyType
+		return config.Put(c)
+
+	case "encryption":
+		return setKMSKeyName(c, strings.TrimSpace(r.FormValue("kmsKeyName")))
+	}
+
+	if action == "register" {
+		// Forget the deactivated account so a new one is registered next time
+		// it's needed.
+		account, err := GetRegisteredAccount(c, directoryURL)
+		if err != nil {
+			return err
+		}
+		if !account.IsDeactivated() {
+			return fmt.Errorf("Account %s is still active", account.AccountID)
+		}
+		log.Infof(c, "Forgetting deactivated account %s", account.AccountID)
+		return datastore.Delete(c, registeredAccountKey(c, directoryURL))
+	}
+
+	if action == "accept-terms" {
+		// Agreeing to the terms is what lets a new account be registered, so
+		// it can't need an account already.
+		account, err := GetRegisteredAccount(c, directoryURL)
+		if err != nil {
+			return err
+		}
+		if account.AccountID == "" {
+			client := &acme.Client{HTTPClient: urlfetch.Client(c), DirectoryURL: directoryURL}
+			if err := agreeToTerms(c, client, account, r.FormValue("terms")); err != nil {
+				return err
+			}
+			if err := account.Put(c); err != nil {
+				return err
+			}
+			if _, _, err := createACMEClient(c, directoryURL); err != nil {
+				return fmt.Errorf("Failed to register: %v", err)
+			}
+			return nil
+		}
+	}
+
+	client, account, err := createACMEClient(c, directoryURL)
+	if err != nil {
+		return fmt.Errorf("Failed to create ACME client: %v", err)
+	}
+
+	switch action {
+	case "contacts":
+		contacts, err := parseContacts(r.FormValue("contacts"))
+		if err != nil {
+			return err
+		}
+		log.Infof(c, "Updating contacts of account %s to %s", account.AccountID, strings.Join(contacts, ", "))
+		if _, err := client.UpdateReg(c, &acme.Account{Contact: contacts}); err != nil {
+			return fmt.Errorf("Failed to update contacts: %v", err)
+		}
+		account.Contacts = contacts
+
+	case "accept-terms":
+		if err := agreeToTerms(c, client, account, r.FormValue("terms")); err != nil {
+			return err
+		}
+
+	case "deactivate":
+		log.Infof(c, "Deactivating account %s", account.AccountID)
+		if err := client.DeactivateReg(c); err != nil {
+			return fmt.Errorf("Failed to deactivate account: %v", err)
+		}
+		account.Deactivated = time.Now()
+
+	default:
+		return fmt.Errorf("Unknown action '%s'", action)
+	}
+
+	return account.Put(c)
+}
+
+// agreeToTerms records that the admin agreed to the CA's current Terms of
+// Service, which they were shown as terms.  The account isn't saved.
+func agreeToTerms(c context.Context, client *acme.Client, account *RegisteredAccount, terms string) error {
+	dir, err := client.Discover(c)
+	if err != nil {
+		return fmt.Errorf("Failed to get the Terms of Service: %v", err)
+	}
+	if terms != dir.Terms {
+		return fmt.Errorf("The Terms of Service changed again, please review them")
+	}
+	log.Infof(c, "Agreeing to %s for account %s", dir.Terms, account.AccountID)
+	account.TermsAgreed = dir.Terms
+	account.TermsAgreedDate = time.Now()
+	return nil
+}
+
+// importAccount replaces our account with the CA with an existing one, eg.
+// from certbot or lego, so certificates keep being issued to the same account.
+// The CA is asked to confirm the key belongs to the account.
+func importAccount(c context.Context, directoryURL, accountURL string, keyData []byte, replace bool) error {
+	key, err := parseAccountKey(keyData)
+	if err != nil {
+		return fmt.Errorf("Failed to parse account key: %v", err)
+	}
+	existing, err := GetRegisteredAccount(c, directoryURL)
+	if err != nil {
+		return err
+	}
+	if existing.AccountID != "" && !existing.IsDeactivated() && !replace {
+		return fmt.Errorf("There's already an account %s with %s", existing.AccountID, caName(directoryURL))
+	}
+
+	client := &acme.Client{
+		Key:          key,
+		HTTPClient:   urlfetch.Client(c),
+		DirectoryURL: directoryURL,
+	}
+	reg, err := client.GetReg(c, "")
+	if err != nil {
+		return fmt.Errorf("Failed to look up the account for this key: %v", err)
+	}
+	if reg.Status != acme.StatusValid {
+		return fmt.Errorf("Account %s is %s", reg.URI, reg.Status)
+	}
+	if accountURL = strings.TrimSpace(accountURL); accountURL != "" && accountURL != reg.URI {
+		return fmt.Errorf("The key belongs to account %s, not %s", reg.URI, accountURL)
+	}
+
+	log.Infof(c, "Importing account %s with %s", reg.URI, caName(directoryURL))
+	account := &RegisteredAccount{
+		Created:      time.Now(),
+		AccountID:    reg.URI,
+		Contacts:     reg.Contact,
+		DirectoryURL: directoryURL,
+	}
+	if err := account.setKey(c, key); err != nil {
+		return err
+	}
+	return account.Put(c)
+}
+
+// setKMSKeyName changes the Cloud KMS key that private keys are encrypted
+// with, and encrypts the stored keys with it.  Keys encrypted with the old one
+// can still be decrypted.
+func setKMSKeyName(c context.Context, name string) error {
+	if name != "" {
+		enc, err := newCloudKMSEncrypter(c, name)
+		if err != nil {
+			return err
+		}
+		if err := checkKeyEncrypter(c, enc); err != nil {
+			return err
+		}
+	}
+
+	config, err := GetConfig(c)
+	if err != nil {
+		return err
+	}
+	log.Infof(c, "Encrypting private keys with '%s'", name)
+	config.KMSKeyName = name
+	if err := config.Put(c); err != nil {
+		return err
+	}
+	return sealStoredKeys(c)
+}
+
+// parseContacts parses email addresses given one per line into mailto URLs.
+func parseContacts(s string) ([]string, error) {
+	var ret []string
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimPrefix(strings.TrimSpace(line), "mailto:")
+		if line == "" {
+			continue
+		}
+		addr, err := mail.ParseAddress(line)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid email address '%s': %v", line, err)
+		}
+		ret = append(ret, "mailto:"+addr.Address)
+	}
+	if len(ret) == 0 {
+		// The CA would ignore an empty list and keep the existing contacts.
+		return nil, fmt.Errorf("At least one contact address is required")
+	}
+	return ret, nil
+}
@@ -1,23 +1,33 @@
 package appengine
 
 import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/davidsansome/parallel"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
 
 	aeapi "google.golang.org/api/appengine/v1beta"
 )
 
 var (
-	autoRenewCertPeriod = 30 * 24 * time.Hour // 30 days
+	// If the CA doesn't suggest when to renew, renew certificates when this
+	// much of their lifetime is left.  30 days for a 90 day certificate.
+	autoRenewLifetimeFraction = 1.0 / 3
 )
 
 func handleAutoRenew(c context.Context, w http.ResponseWriter, r *http.Request) error {
+	// Pick up any operations that lost their task, eg. to a deploy.
+	resumeStalledOperations(c)
+
 	apps, err := createAppengineClient(c)
 	if err != nil {
 		return fmt.Errorf("Failed to create appengine client: %v", err)
@@ -47,34 +57,193 @@ func handleAutoRenew(c context.Context, w http.ResponseWriter, r *http.Request)
 		return err
 	}
 
-	// Renew any certificates that will expire soon.
+	// Group the domains by certificate.  A certificate can be mapped to several
+	// domains but it only needs renewing once.
+	mapped := map[string][]string{}
 	for _, domain := range domainMappings {
 		if domain.SslSettings == nil {
 			continue
 		}
-
-		cert, ok := certs[domain.SslSettings.CertificateId]
-		if !ok {
+		if _, ok := certs[domain.SslSettings.CertificateId]; !ok {
 			log.Warningf(c, "Couldn't find certificate %s for %s", domain.SslSettings.CertificateId, domain.Id)
 			continue
 		}
+		mapped[domain.SslSettings.CertificateId] = append(mapped[domain.SslSettings.CertificateId], domain.Id)
+	}
 
-		expiry, err := time.Parse(expireTimeFormat, cert.ExpireTime)
+	// Find any certificates that are due for renewal.
+	renew := map[string][]string{}
+	endpoints := map[string]string{}
+	for certID, hostnames := range mapped {
+		cert := certs[certID]
+		parsed, err := parseAuthorizedCert(cert)
 		if err != nil {
-			log.Warningf(c, "Couldn't parse expiry time '%s' for %s, skipping domain", cert.ExpireTime, domain.Id)
+			log.Warningf(c, "Skipping certificate: %v", err)
 			continue
 		}
+		expiry := parsed.NotAfter
 
-		if time.Now().Add(autoRenewCertPeriod).After(expiry) {
-			log.Infof(c, "Cert for %s expires on %s, renewing now", domain.Id, expiry.String())
-			if err := delayFunc(c, createFunc, domain.Id); err != nil {
-				log.Errorf(c, "Failed to schedule auto-renew for %s: %v", domain.Id, err)
-				// Continue anyway.
-			}
+		// Ask the CA when to renew, falling back to a fraction of the
+		// certificate's lifetime before expiry if it can't tell us.
+		lifetime := parsed.NotAfter.Sub(parsed.NotBefore)
+		renewBefore := time.Duration(float64(lifetime) * autoRenewLifetimeFraction)
+		renewAt := expiry.Add(-renewBefore)
+		if window, err := updateRenewalWindow(c, cert, parsed, hostnames, endpoints); err != nil {
+			log.Warningf(c, "No renewal info for %s, renewing %s before expiry: %v", certID, renewBefore, err)
 		} else {
-			log.Infof(c, "Not renewing %s - cert expires on %s", domain.Id, expiry.String())
+			renewAt = window.RenewAt
+		}
+
+		if !time.Now().Before(renewAt) {
+			log.Infof(c, "Cert for %s expires on %s, renewing now", strings.Join(hostnames, ", "), expiry.String())
+			renew[certID] = hostnames
+		} else {
+			log.Infof(c, "Not renewing %s until %s - cert expires on %s", strings.Join(hostnames, ", "), renewAt.String(), expiry.String())
+		}
+	}
+
+	// Count what each CA has issued recently so a misbehaving cron doesn't use
+	// up its rate limits.
+	config, err := GetConfig(c)
+	if err != nil {
+		return err
+	}
+	budgets := map[string]*issuanceBudget{}
+	for _, directoryURL := range config.DirectoryURLs() {
+		if budgets[directoryURL], err = loadIssuanceBudget(c, config, directoryURL); err != nil {
+			return err
+		}
+	}
+
+	for certID, mapped := range renew {
+		// Get a new certificate with the same names as the old one.
+		hostnames := certs[certID].DomainNames
+		if len(hostnames) == 0 {
+			hostnames = mapped
+		}
+
+		// Leave it for a later run if no CA has the budget for it now.
+		if err := reserveIssuance(config, budgets, hostnames); err != nil {
+			log.Warningf(c, "Not renewing %s yet: %v", strings.Join(hostnames, ", "), err)
+			continue
+		}
+
+		// Lease the hostnames now so we can tell if they're already being
+		// renewed.  The task takes the leases over.
+		leaseID := newLeaseID()
+		var leaseErr *leaseError
+		if err := acquireHostNameLeases(c, hostnames, leaseID); errors.As(err, &leaseErr) {
+			log.Infof(c, "Not renewing %s: %v", strings.Join(hostnames, ", "), err)
+			continue
+		} else if err != nil {
+			log.Errorf(c, "Failed to lease %s: %v", strings.Join(hostnames, ", "), err)
+			continue
+		}
+
+		if err := delayFunc(c, createFunc, hostnames, leaseID); err != nil {
+			log.Errorf(c, "Failed to schedule auto-renew for %s: %v", strings.Join(hostnames, ", "), err)
+			releaseHostNameLeases(c, hostnames, leaseID)
+			// Continue anyway.
 		}
 	}
 
 	return nil
 }
+
+// updateRenewalWindow asks the certificate's CA for its suggested renewal
+// window and saves it for each of the hostnames.  endpoints caches each CA's
+// renewalInfo URL.  The CA is only asked again once its Retry-After has passed.
+func updateRenewalWindow(c context.Context, cert *aeapi.AuthorizedCertificate, parsed *x509.Certificate, hostnames []string, endpoints map[string]string) (*RenewalWindow, error) {
+	window, err := GetRenewalWindow(c, hostnames[0])
+	if err != nil {
+		return nil, err
+	}
+	if window.CertificateID == cert.Id && time.Now().Before(window.NextCheck) {
+		return window, nil
+	}
+
+	uploaded, err := GetUploadedCertificate(c, cert.Id)
+	if err == datastore.ErrNoSuchEntity {
+		return nil, fmt.Errorf("Don't know which CA issued %s", cert.Id)
+	} else if err != nil {
+		return nil, err
+	}
+	directoryURL := uploaded.DirectoryURL
+	endpoint, ok := endpoints[directoryURL]
+	if !ok {
+		if endpoint, err = renewalInfoURL(c, directoryURL); err != nil {
+			return nil, err
+		}
+		endpoints[directoryURL] = endpoint
+	}
+	if endpoint == "" {
+		return nil, fmt.Errorf("%s doesn't support renewal info", caName(directoryURL))
+	}
+
+	info, err := fetchRenewalInfo(c, endpoint, parsed)
+	if err != nil {
+		if window.CertificateID == cert.Id {
+			// Keep using the last window the CA gave us.
+			log.Warningf(c, "Failed to update renewal info for %s: %v", cert.Id, err)
+			return window, nil
+		}
+		return nil, err
+	}
+
+	// Only pick a new time if the window moved, so we don't keep putting the
+	// renewal off.  If the CA moved the window into the past (eg. because the
+	// certificate is going to be revoked) the new time is already due.
+	start, end := info.SuggestedWindow.Start, info.SuggestedWindow.End
+	if window.CertificateID != cert.Id || !window.Start.Equal(start) || !window.End.Equal(end) {
+		window.RenewAt = randomTimeInWindow(start, end)
+		log.Infof(c, "%s suggests renewing %s between %s and %s, picked %s",
+			caName(directoryURL), cert.Id, start, end, window.RenewAt)
+	}
+	window.CertificateID = cert.Id
+	window.Start = start
+	window.End = end
+	window.ExplanationURL = info.ExplanationURL
+	window.Checked = time.Now()
+	window.NextCheck = window.Checked.Add(info.RetryAfter)
+
+	for _, hostname := range hostnames {
+		if err := window.Put(c, hostname); err != nil {
+			return nil, fmt.Errorf("Failed to save renewal window for %s: %v", hostname, err)
+		}
+	}
+	return window, nil
+}
+
+// reserveIssuance counts a certificate for the hostnames against the budget of
+// the first CA that has room for it, or returns why none of them do.
+func reserveIssuance(config *Config, budgets map[string]*issuanceBudget, hostnames []string) error {
+	var firstErr error
+	for _, directoryURL := range config.DirectoryURLs() {
+		budget := budgets[directoryURL]
+		err := budget.check(hostnames)
+		if err == nil {
+			budget.reserve(hostnames)
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// parseAuthorizedCert parses the leaf certificate uploaded to App Engine.
+func parseAuthorizedCert(cert *aeapi.AuthorizedCertificate) (*x509.Certificate, error) {
+	if cert.CertificateRawData == nil {
+		return nil, fmt.Errorf("Certificate %s has no certificate data", cert.Id)
+	}
+	block, _ := pem.Decode([]byte(cert.CertificateRawData.PublicCertificate))
+	if block == nil {
+		return nil, fmt.Errorf("Certificate %s isn't PEM encoded", cert.Id)
+	}
+	parsed, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse certificate %s: %v", cert.Id, err)
+	}
+	return parsed, nil
+}
@@ -0,0 +1,155 @@
+package appengine
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/davidsansome/parallel"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	csrPEMType = "CERTIFICATE REQUEST"
+)
+
+// handleCSR gets a certificate for a CSR generated elsewhere, so we never see
+// its private key.  GET downloads the chain once it's been issued.
+func handleCSR(c context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method == "GET" {
+		cc, err := GetCSRCertificate(c, r.FormValue("order"))
+		if err == datastore.ErrNoSuchEntity {
+			http.NotFound(w, r)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		w.Header().Set("Content-Type", "application/x-pem-file")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s.pem\"", cc.HostNames[0]))
+		_, err = w.Write(cc.Chain)
+		return err
+	}
+	if r.Method != "POST" {
+		return fmt.Errorf("Invalid method %s", r.Method)
+	}
+
+	block, _ := pem.Decode([]byte(r.FormValue("csr")))
+	if block == nil || block.Type != csrPEMType {
+		return fmt.Errorf("Missing PEM encoded %s", csrPEMType)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("Invalid CSR: %v", err)
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return fmt.Errorf("Invalid CSR signature: %v", err)
+	}
+
+	hostnames := csrHostNames(csr)
+	if len(hostnames) == 0 {
+		return fmt.Errorf("The CSR doesn't have any hostnames")
+	}
+	if err := checkMappedAndAuthorized(c, hostnames); err != nil {
+		return err
+	}
+
+	maybeTriggerAsyncCleanup(c)
+	var leaseErr *leaseError
+	if err := createOrder(c, hostnames, block.Bytes, nil, newLeaseID()); errors.As(err, &leaseErr) {
+		log.Infof(c, "%v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/ssl-certificates/status", http.StatusFound)
+	return nil
+}
+
+// csrHostNames returns the hostnames the CSR asks for.  The common name comes
+// first if it has one, since that's what we use as the primary hostname.
+func csrHostNames(csr *x509.CertificateRequest) []string {
+	var hostnames []string
+	if csr.Subject.CommonName != "" {
+		hostnames = append(hostnames, csr.Subject.CommonName)
+	}
+	return uniqueHostNames(append(hostnames, csr.DNSNames...))
+}
+
+// checkMappedAndAuthorized returns an error unless every hostname is mapped to
+// this app and our service account is authorized on it.
+func checkMappedAndAuthorized(c context.Context, hostnames []string) error {
+	apps, err := createAppengineClient(c)
+	if err != nil {
+		return fmt.Errorf("Failed to create appengine client: %v", err)
+	}
+	project := appengine.AppID(c)
+
+	mapped := map[string]struct{}{}
+	authorized := map[string]struct{}{}
+	if err := parallel.Parallel(nil, nil, func() error {
+		resp, err := apps.DomainMappings.List(project).Do()
+		if err != nil {
+			return fmt.Errorf("DomainMappings fetch failed: %v", err)
+		}
+		for _, domain := range resp.DomainMappings {
+			mapped[domain.Id] = struct{}{}
+		}
+		return nil
+	}, func() error {
+		resp, err := apps.AuthorizedDomains.List(project).Do()
+		if err != nil {
+			return fmt.Errorf("AuthorizedDomains fetch failed: %v", err)
+		}
+		for _, domain := range resp.Domains {
+			authorized[domain.Id] = struct{}{}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	for _, hostname := range hostnames {
+		if _, ok := mapped[hostname]; !ok {
+			return fmt.Errorf("%s isn't mapped to %s", hostname, project)
+		}
+		if !isAuthorizedSubdomain(hostname, authorized) {
+			return fmt.Errorf("%s isn't authorized for %s", hostname, project)
+		}
+	}
+	return nil
+}
+
+// saveCSRCertificate stores the chain issued for the operation's provided
+// CSR so it can be downloaded.
+func saveCSRCertificate(c context.Context, cr *CreateOperation, chain [][]byte) error {
+	chainPEM, err := pemEncode(certificatePEMType, chain)
+	if err != nil {
+		return fmt.Errorf("Failed to PEM-encode certificate chain: %v", err)
+	}
+	cert, err := x509.ParseCertificate(chain[0])
+	if err != nil {
+		return fmt.Errorf("Failed to parse certificate: %v", err)
+	}
+
+	cc := &CSRCertificate{
+		HostNames:    cr.AllHostNames(),
+		DirectoryURL: cr.DirectoryURL,
+		OrderURI:     cr.OrderURI,
+		Chain:        chainPEM,
+		Issued:       time.Now(),
+		Expiry:       cert.NotAfter,
+	}
+	if err := cc.Put(c); err != nil {
+		return fmt.Errorf("Failed to save certificate: %v", err)
+	}
+	log.Infof(c, "Saved certificate for the CSR for %s", cr.HostName)
+	return nil
+}
@@ -13,17 +13,17 @@ import (
 func handleChallenge(c context.Context, w http.ResponseWriter, r *http.Request) error {
 	token := strings.TrimPrefix(r.URL.Path, challengePathPrefix)
 
-	// Find the CreateOperation in datastore.
-	cr, err := GetCreateOperation(c, token)
+	// Find the challenge in datastore.
+	ch, err := GetChallenge(c, token)
 	if err != nil {
 		return err
 	}
 
-	log.Infof(c, "Responding to challenge %s with %s", cr.ChallengeURI, cr.Response)
-	io.WriteString(w, cr.Response)
+	log.Infof(c, "Responding to challenge %s for order %s with %s", token, ch.OrderURI, ch.Response)
+	io.WriteString(w, ch.Response)
 
-	cr.Responded = time.Now()
-	cr.Put(c)
-
-	return delayFunc(c, issueCertificateFunc, cr)
+	// Record it on the challenge rather than the operation, which the driver
+	// task saves after every step and would overwrite.
+	ch.Responded = time.Now()
+	return PutChallenge(c, token, ch)
 }
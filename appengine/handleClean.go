@@ -12,6 +12,9 @@ import (
 
 const (
 	asyncCleanupProbability = 0.2
+
+	// The most entities datastore will delete in one call.
+	deleteBatchSize = 500
 )
 
 func maybeTriggerAsyncCleanup(c context.Context) {
@@ -22,6 +25,18 @@ func maybeTriggerAsyncCleanup(c context.Context) {
 
 var cleanFunc = delay.Func("clean",
 	func(c context.Context) error {
+		// Encrypt any private keys that were stored before there was a key
+		// encrypter, or with a different key.
+		if err := sealStoredKeys(c); err != nil {
+			log.Warningf(c, "Failed to encrypt stored keys: %v", err)
+		}
+
+		// Leases are deleted on their own, so one acquired again in the
+		// meantime isn't lost.
+		if err := deleteExpiredHostNameLeases(c); err != nil {
+			log.Warningf(c, "Failed to delete expired leases: %v", err)
+		}
+
 		ops, err := GetAllCreateOperations(c)
 		if err != nil {
 			return err
@@ -29,18 +44,116 @@ var cleanFunc = delay.Func("clean",
 
 		var expiredKeys []*datastore.Key
 
+		// Orders of the operations we keep, whose challenges are still
+		// needed.
+		kept := map[string]bool{}
+
 		now := time.Now()
 		for _, op := range ops {
-			if now.After(op.Accepted.Add(createOperationHardExpiry)) {
+			if !op.isExpired(now) {
+				kept[op.OrderURI] = true
+			} else {
 				expiredKeys = append(expiredKeys, op.Key)
+
+				// Certificates uploaded before we recorded them are only
+				// known from their operation.
+				if op.MappedCertificateID != "" {
+					if _, err := GetUploadedCertificate(c, op.MappedCertificateID); err == datastore.ErrNoSuchEntity {
+						op.CertificateID = op.MappedCertificateID
+						if err := saveUploadedCertificate(c, op); err != nil {
+							return err
+						}
+					}
+				}
+
+				// And the private key of any certificate it didn't upload,
+				// and its event log.
+				if op.OrderURI != "" {
+					expiredKeys = append(expiredKeys, certificateKeyKey(c, op.OrderURI))
+
+					eventKeys, err := datastore.NewQuery(operationEventKind).
+						Ancestor(op.Key).KeysOnly().GetAll(c, nil)
+					if err != nil {
+						return err
+					}
+					expiredKeys = append(expiredKeys, eventKeys...)
+				}
 			}
 		}
 
+		// Challenge responses are no use after their operation has expired.
+		var challenges []*Challenge
+		challengeKeys, err := datastore.NewQuery(challengeKind).
+			Filter("Created <", now.Add(-createOperationHardExpiry)).
+			GetAll(c, &challenges)
+		if err != nil {
+			return err
+		}
+		for i, ch := range challenges {
+			if !kept[ch.OrderURI] {
+				expiredKeys = append(expiredKeys, challengeKeys[i])
+			}
+		}
+
+		authorizationKeys, err := datastore.NewQuery(cachedAuthorizationKind).
+			Filter("Expires <", now).
+			KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		expiredKeys = append(expiredKeys, authorizationKeys...)
+
+		// Issuances only count against the budget for a week.
+		issuanceKeys, err := datastore.NewQuery(issuanceKind).
+			Filter("Issued <", now.Add(-issuanceBudgetPeriod)).
+			KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		expiredKeys = append(expiredKeys, issuanceKeys...)
+
+		csrCertificateKeys, err := datastore.NewQuery(csrCertificateKind).
+			Filter("Expiry <", now).
+			KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		expiredKeys = append(expiredKeys, csrCertificateKeys...)
+
+		uploadedKeys, err := datastore.NewQuery(uploadedCertificateKind).
+			Filter("Expiry <", now).
+			KeysOnly().GetAll(c, nil)
+		if err != nil {
+			return err
+		}
+		expiredKeys = append(expiredKeys, uploadedKeys...)
+
 		if len(expiredKeys) == 0 {
 			log.Infof(c, "Nothing to clean up")
 			return nil
 		}
 
-		log.Infof(c, "Deleting %d expired create operations...", len(expiredKeys))
-		return datastore.DeleteMulti(c, expiredKeys)
+		log.Infof(c, "Deleting %d expired entities...", len(expiredKeys))
+		return deleteInBatches(c, expiredKeys)
 	})
+
+// deleteInBatches deletes the keys a batch at a time.  A batch that fails
+// doesn't stop the others, the first error is returned once they've all been
+// tried.
+func deleteInBatches(c context.Context, keys []*datastore.Key) error {
+	var ret error
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > deleteBatchSize {
+			n = deleteBatchSize
+		}
+		if err := datastore.DeleteMulti(c, keys[:n]); err != nil {
+			log.Warningf(c, "Failed to delete %d expired entities: %v", n, err)
+			if ret == nil {
+				ret = err
+			}
+		}
+		keys = keys[n:]
+	}
+	return ret
+}
@@ -1,10 +1,13 @@
 package appengine
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"strings"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/delay"
 	"google.golang.org/appengine/log"
@@ -14,12 +17,18 @@ func handleCreate(c context.Context, w http.ResponseWriter, r *http.Request) err
 	if r.Method != "POST" {
 		return fmt.Errorf("Invalid method %s", r.Method)
 	}
-	hostname := r.FormValue("hostname")
-	if hostname == "" {
+	r.ParseForm()
+	hostnames := uniqueHostNames(r.Form["hostname"])
+	if len(hostnames) == 0 {
 		return fmt.Errorf("Missing hostname parameter")
 	}
 
-	if err := doCreate(c, hostname); err != nil {
+	var leaseErr *leaseError
+	if err := doCreate(c, hostnames, newLeaseID()); errors.As(err, &leaseErr) {
+		log.Infof(c, "%v", err)
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil
+	} else if err != nil {
 		return err
 	}
 
@@ -27,68 +36,314 @@ func handleCreate(c context.Context, w http.ResponseWriter, r *http.Request) err
 	return nil
 }
 
-func doCreate(c context.Context, hostname string) error {
+// doCreate starts getting a single certificate covering all the hostnames.
+// The first hostname becomes the certificate's common name.
+func doCreate(c context.Context, hostnames []string, leaseID string) error {
 	maybeTriggerAsyncCleanup(c)
+	return createOrder(c, hostnames, nil, nil, leaseID)
+}
+
+// createOrder starts an order with the first configured CA that isn't in
+// failed, moving on to the next one if a CA rate limits us.  csr is the DER
+// certificate signing request to finalize the order with, or nil to generate a
+// key.  The hostnames are leased to leaseID until the operation finishes, and
+// a *leaseError is returned if another operation already has them.
+func createOrder(c context.Context, hostnames []string, csr []byte, failed []string, leaseID string) error {
+	if err := acquireHostNameLeases(c, hostnames, leaseID); err != nil {
+		return err
+	}
+	err := createOrderWithLeases(c, hostnames, csr, failed, leaseID)
+	if err != nil {
+		releaseHostNameLeases(c, hostnames, leaseID)
+	}
+	return err
+}
+
+func createOrderWithLeases(c context.Context, hostnames []string, csr []byte, failed []string, leaseID string) error {
+	config, err := GetConfig(c)
+	if err != nil {
+		return fmt.Errorf("Failed to get config: %v", err)
+	}
+
+	// CAs that won't be used for these hostnames are skipped, but the first
+	// reason is recorded if none of them can be used.
+	var refused error
+	var refusedBy string
+	for {
+		directoryURL := nextDirectoryURL(config, failed)
+		if directoryURL == "" {
+			if refused != nil {
+				return refuseOperation(c, hostnames, refusedBy, refused, leaseID)
+			}
+			return fmt.Errorf("Every CA failed for %s", strings.Join(hostnames, ", "))
+		}
+
+		budget, err := loadIssuanceBudget(c, config, directoryURL)
+		if err != nil {
+			return err
+		}
+		err = budget.check(hostnames)
+		if err == nil {
+			err = startOrder(c, hostnames, csr, directoryURL, failed, leaseID)
+		}
+
+		var caaErr *caaError
+		var budgetErr *budgetError
+		switch {
+		case errors.As(err, &caaErr), errors.As(err, &budgetErr):
+			log.Warningf(c, "%v", err)
+			if refused == nil {
+				refused, refusedBy = err, directoryURL
+			}
+		case isRateLimited(err):
+			log.Warningf(c, "Rate limited by %s: %v", directoryURL, err)
+		default:
+			return err
+		}
+		// Copy failed rather than appending to the caller's slice.
+		failed = append(append([]string(nil), failed...), directoryURL)
+	}
+}
+
+// refuseOperation records an operation that was refused before an order was
+// created, so the reason shows up on the status page.
+func refuseOperation(c context.Context, hostnames []string, directoryURL string, reason error, leaseID string) error {
+	cr := &CreateOperation{
+		HostName:     hostnames[0],
+		HostNames:    hostnames,
+		DirectoryURL: directoryURL,
+		LeaseID:      leaseID,
+		Accepted:     time.Now(),
+		IsFinished:   true,
+	}
+	cr.setError(reason)
+	cr.Failure.Step = "ordering"
+	cr.State = stateFailed
+	if err := cr.Put(c); err != nil {
+		return fmt.Errorf("Failed to save operation: %v", err)
+	}
+	releaseHostNameLeases(c, hostnames, leaseID)
+	return nil
+}
 
-	client, _, err := createACMEClient(c)
+// startOrder creates an order with a single CA and gets the responses to its
+// challenges ready.
+func startOrder(c context.Context, hostnames []string, csr []byte, directoryURL string, failed []string, leaseID string) error {
+	client, _, err := createACMEClient(c, directoryURL)
 	if err != nil {
 		return fmt.Errorf("Failed to create ACME client: %v", err)
 	}
 
-	log.Infof(c, "Authorizing %s", hostname)
-	auth, err := client.Authorize(c, hostname)
+	// Check the CA is allowed to issue for every hostname before the order
+	// fails and counts against our rate limits.
+	for _, hostname := range hostnames {
+		if err := checkCAA(c, hostname, client.DirectoryURL, string(client.KID)); err != nil {
+			return err
+		}
+	}
+
+	// The primary hostname's settings apply to the certificate as a whole.
+	settings, err := GetDomainSettings(c, hostnames[0])
 	if err != nil {
-		return fmt.Errorf("Failed to authorize client: %v", err)
+		return fmt.Errorf("Failed to get settings for %s: %v", hostnames[0], err)
 	}
 
-	for _, challenge := range auth.Challenges {
-		if challenge.Type != "http-01" {
+	log.Infof(c, "Creating order for %s with %s", strings.Join(hostnames, ", "), directoryURL)
+	var notAfter time.Time
+	if settings.ValidityDays > 0 {
+		notAfter = time.Now().Add(time.Duration(settings.ValidityDays) * 24 * time.Hour)
+	}
+	var order *acme.Order
+	if settings.Profile != "" {
+		if !notAfter.IsZero() {
+			log.Infof(c, "Not asking for %d days validity, the '%s' profile decides it", settings.ValidityDays, settings.Profile)
+		}
+		order, err = authorizeOrderWithProfile(c, client, hostnames, settings.Profile)
+	} else {
+		var opts []acme.OrderOption
+		if !notAfter.IsZero() {
+			opts = append(opts, acme.WithOrderNotAfter(notAfter))
+		}
+		order, err = client.AuthorizeOrder(c, acme.DomainIDs(hostnames...), opts...)
+	}
+	if err != nil {
+		return fmt.Errorf("Failed to create order: %w", err)
+	}
+	log.Infof(c, "Created order %s (%s)", order.URI, order.Status)
+
+	cr := &CreateOperation{
+		HostName:     hostnames[0],
+		HostNames:    hostnames,
+		DirectoryURL: client.DirectoryURL,
+		FailedOver:   failed,
+		OrderURI:     order.URI,
+		FinalizeURI:  order.FinalizeURL,
+		Profile:      settings.Profile,
+		ValidityDays: settings.ValidityDays,
+		ProvidedCSR:  csr,
+		LeaseID:      leaseID,
+		Accepted:     time.Now(),
+	}
+	if csr == nil {
+		// The key and CSR settings only matter if we're making the CSR.
+		cr.KeyType = settings.KeyType
+		cr.CSR = settings.CSR
+	}
+
+	// Remove any TXT records we've created if the order can't be started.
+	// Once the operation is saved they're cleaned up when it finishes.
+	saved := false
+	defer func() {
+		if !saved {
+			cleanupDNSRecords(c, cr)
+		}
+	}()
+
+	// Get a response ready for every authorization that's still pending.  The
+	// CA includes any valid authorizations it already gave us in the order, so
+	// we only need to fetch the ones we don't know about.
+	cached := reusableAuthorizations(c, client)
+	for _, authzURI := range order.AuthzURLs {
+		if auth, ok := cached[authzURI]; ok {
+			log.Infof(c, "Reusing authorization for %s, valid until %s", auth.HostName, auth.Expires)
+			cr.Authorizations = append(cr.Authorizations, Authorization{
+				URI:      auth.URI,
+				HostName: auth.HostName,
+			})
 			continue
 		}
 
-		log.Infof(c, "Received http challenge (%s) %s, token %s",
-			challenge.Status, challenge.URI, challenge.Token)
+		auth, err := client.GetAuthorization(c, authzURI)
+		if err != nil {
+			return fmt.Errorf("Failed to get authorization %s: %v", authzURI, err)
+		}
+
+		a := Authorization{
+			URI:      auth.URI,
+			HostName: auth.Identifier.Value,
+		}
+		if auth.Wildcard {
+			a.HostName = "*." + a.HostName
+		}
+		if auth.Status == acme.StatusValid {
+			// We've already authorized this domain, nothing to do.
+			log.Infof(c, "Authorization for %s is already valid", a.HostName)
+			cacheAuthorization(c, client, auth)
+			cr.Authorizations = append(cr.Authorizations, a)
+			continue
+		}
 
-		// Get a response ready.
-		response, err := client.HTTP01ChallengeResponse(challenge.Token)
+		// Each domain can be authorized in a different way.
+		authSettings, err := GetDomainSettings(c, a.HostName)
 		if err != nil {
-			return fmt.Errorf("Failed to create response to %s: %v", challenge.Token, err)
-		}
-
-		cr := &CreateOperation{
-			HostName:         hostname,
-			AuthorizationURI: auth.URI,
-			ChallengeURI:     challenge.URI,
-			Token:            challenge.Token,
-			Response:         response,
-			Accepted:         time.Now(),
-		}
-		// Record the challenge and response in datastore.
-		if err := cr.Put(c); err != nil {
-			return fmt.Errorf("Failed to save challenge: %v", err)
-		}
-
-		switch challenge.Status {
-		case "valid":
-			// We've already authorized this domain, skip straight to requesting
-			// another certificate.
-			// Get the existing one from datastore if we can.
-			log.Infof(c, "Challenge is already valid, getting certificate")
-			if existingCr, err := GetCreateOperation(c, challenge.Token); err == nil {
-				cr = existingCr
+			return fmt.Errorf("Failed to get settings for %s: %v", a.HostName, err)
+		}
+
+		// Wildcards can only be authorized with DNS.
+		a.ChallengeType = authSettings.ChallengeType
+		if auth.Wildcard {
+			a.ChallengeType = challengeTypeDNS
+		}
+
+		challenge := findChallenge(auth, a.ChallengeType)
+		if challenge == nil {
+			return fmt.Errorf("No %s challenge offered for %s", a.ChallengeType, a.HostName)
+		}
+		log.Infof(c, "Received %s challenge (%s) %s, token %s",
+			challenge.Type, challenge.Status, challenge.URI, challenge.Token)
+		a.ChallengeURI = challenge.URI
+		a.Token = challenge.Token
+
+		switch a.ChallengeType {
+		case challengeTypeHTTP:
+			response, err := client.HTTP01ChallengeResponse(challenge.Token)
+			if err != nil {
+				return fmt.Errorf("Failed to create response to %s: %v", challenge.Token, err)
 			}
-			return delayFunc(c, issueCertificateFunc, cr)
 
-		default:
-			// Accept the challenge.
-			if _, err := client.Accept(c, challenge); err != nil {
-				return fmt.Errorf("Failed to accept challenge: %v", err)
+			// Record the challenge and response in datastore.
+			if err := PutChallenge(c, challenge.Token, &Challenge{
+				OrderURI: order.URI,
+				Response: response,
+				Created:  time.Now(),
+			}); err != nil {
+				return fmt.Errorf("Failed to save challenge: %v", err)
+			}
+
+		case challengeTypeDNS:
+			record, err := client.DNS01ChallengeRecord(challenge.Token)
+			if err != nil {
+				return fmt.Errorf("Failed to create response to %s: %v", challenge.Token, err)
 			}
-			log.Infof(c, "Accepted challenge")
+			if err := presentDNSRecord(c, authSettings, a.HostName, record); err != nil {
+				return err
+			}
+			a.DNSRecord = record
+		}
+		cr.Authorizations = append(cr.Authorizations, a)
+	}
+
+	// If everything was already authorized we skip straight to requesting
+	// another certificate.
+	cr.State = stateValidating
+	for _, a := range cr.Authorizations {
+		if a.ChallengeURI != "" {
+			cr.State = stateAccepting
+		}
+	}
+	if err := cr.Put(c); err != nil {
+		return fmt.Errorf("Failed to save operation: %v", err)
+	}
+	saved = true
+	recordEvent(c, cr, OperationEvent{Type: eventCreated})
+	return delayFunc(c, advanceOperationFunc, cr.OrderURI)
+}
+
+// uniqueHostNames returns the non-empty hostnames with duplicates removed,
+// keeping their original order.
+func uniqueHostNames(hostnames []string) []string {
+	var ret []string
+	seen := map[string]struct{}{}
+	for _, hostname := range hostnames {
+		hostname = strings.ToLower(strings.TrimSpace(hostname))
+		if _, ok := seen[hostname]; ok || hostname == "" {
+			continue
+		}
+		seen[hostname] = struct{}{}
+		ret = append(ret, hostname)
+	}
+	return ret
+}
+
+// findChallenge returns the challenge of the given type from the
+// authorization, or nil if the CA didn't offer one.
+func findChallenge(auth *acme.Authorization, typ string) *acme.Challenge {
+	for _, challenge := range auth.Challenges {
+		if challenge.Type == typ {
+			return challenge
 		}
-		break
 	}
 	return nil
 }
 
-var createFunc = delay.Func("create", doCreate)
+var createFunc = delay.Func("create-order", doCreate)
+
+// legacyCreateFunc runs tasks queued by versions that took a single hostname
+// under the old name, which would otherwise fail to decode and use up their
+// retries.  It queues the same work as a createFunc task instead.
+var legacyCreateFunc = delay.Func("create", func(c context.Context, hostname string) error {
+	hostnames := []string{hostname}
+	leaseID := newLeaseID()
+	var leaseErr *leaseError
+	if err := acquireHostNameLeases(c, hostnames, leaseID); errors.As(err, &leaseErr) {
+		log.Infof(c, "Not creating %s: %v", hostname, err)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to lease %s: %v", hostname, err)
+	}
+	if err := delayFunc(c, createFunc, hostnames, leaseID); err != nil {
+		releaseHostNameLeases(c, hostnames, leaseID)
+		return err
+	}
+	return nil
+})
@@ -0,0 +1,72 @@
+package appengine
+
+import (
+	"fmt"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// How long to wait for TXT records to propagate before giving up and
+	// letting the task be retried.
+	dnsPropagationTimeout  = 2 * time.Minute
+	dnsPropagationInterval = 5 * time.Second
+)
+
+// acceptChallenges tells the CA the challenge responses are ready.  The DNS
+// challenges can't be accepted until the TXT records are visible.
+func acceptChallenges(c context.Context, cr *CreateOperation) error {
+	// Wait until every authoritative nameserver has the TXT records, otherwise
+	// the CA might look too early and fail the challenge.
+	deadline := time.Now().Add(dnsPropagationTimeout)
+	for _, a := range cr.Authorizations {
+		if a.ChallengeType != challengeTypeDNS || a.ChallengeURI == "" {
+			continue
+		}
+		fqdn := dnsChallengeName(a.HostName)
+		for {
+			ok, err := checkDNSPropagation(c, fqdn, a.DNSRecord)
+			if err != nil {
+				return fmt.Errorf("Failed to check TXT record for %s: %v", fqdn, err)
+			}
+			if ok {
+				log.Infof(c, "TXT record for %s has propagated", fqdn)
+				break
+			}
+			if time.Now().After(deadline) {
+				return fmt.Errorf("TXT record for %s hasn't propagated yet, will retry later", fqdn)
+			}
+			time.Sleep(dnsPropagationInterval)
+		}
+	}
+
+	client, _, err := createACMEClient(c, cr.DirectoryURL)
+	if err != nil {
+		return fmt.Errorf("Failed to create ACME client: %v", err)
+	}
+
+	for _, a := range cr.Authorizations {
+		if a.ChallengeURI == "" {
+			continue
+		}
+		if _, err := client.Accept(c, &acme.Challenge{URI: a.ChallengeURI}); err != nil {
+			return fmt.Errorf("Failed to accept challenge: %w", err)
+		}
+		log.Infof(c, "Accepted challenge %s", a.ChallengeURI)
+	}
+
+	// Wait for the CA to validate the challenges.
+	cr.State = stateValidating
+	return nil
+}
+
+// legacyAcceptDNSChallengesFunc runs tasks queued by versions before
+// operations could be resumed, which would otherwise fail to decode and use up
+// their retries.
+var legacyAcceptDNSChallengesFunc = delay.Func("accept-dns-challenges", func(c context.Context, cr *CreateOperation) error {
+	return resumeLegacyOperation(c, cr.OrderURI, stateAccepting, nil)
+})
@@ -1,14 +1,29 @@
 package appengine
 
 import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"net/http"
+	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
+	"google.golang.org/appengine/datastore"
 	"google.golang.org/appengine/log"
+	"google.golang.org/appengine/urlfetch"
 )
 
+// revocationReasons are the reasons a certificate can be revoked for on the
+// status page.
+var revocationReasons = map[string]acme.CRLReasonCode{
+	"unspecified":   acme.CRLReasonUnspecified,
+	"keyCompromise": acme.CRLReasonKeyCompromise,
+	"superseded":    acme.CRLReasonSuperseded,
+}
+
 func handleDelete(c context.Context, w http.ResponseWriter, r *http.Request) error {
 	if r.Method != "POST" {
 		return fmt.Errorf("Invalid method %s", r.Method)
@@ -23,11 +38,143 @@ func handleDelete(c context.Context, w http.ResponseWriter, r *http.Request) err
 		return fmt.Errorf("Failed to create appengine client: %v", err)
 	}
 
+	// Revoke the certificate first so it's still there to try again if that
+	// fails.
+	if reason := r.FormValue("revoke"); reason != "" {
+		cert, err := apps.AuthorizedCertificates.Get(appengine.AppID(c), certID).Do()
+		if err != nil {
+			return fmt.Errorf("Failed to get certificate %s: %v", certID, err)
+		}
+		if cert.CertificateRawData == nil {
+			return fmt.Errorf("Certificate %s has no certificate data", certID)
+		}
+		if err := revokeCert(c, certID, []byte(cert.CertificateRawData.PublicCertificate),
+			reason, privateKeyPEM(r.FormValue("certKey")), r.FormValue("directoryURL")); err != nil {
+			return err
+		}
+	}
+
 	log.Infof(c, "Deleting certificate ID %s", certID)
 	if _, err := apps.AuthorizedCertificates.Delete(appengine.AppID(c), certID).Do(); err != nil {
 		return fmt.Errorf("Failed to delete certificate %s: %v", certID, err)
 	}
+	if err := DeleteUploadedCertificate(c, certID); err != nil {
+		log.Warningf(c, "Failed to forget certificate %s: %v", certID, err)
+	}
 
 	http.Redirect(w, r, "/ssl-certificates/status", http.StatusFound)
 	return nil
 }
+
+// revokeCert revokes the PEM-encoded certificate with the CA that issued it.
+// The request is signed with the certificate's private key if one is given,
+// otherwise with the account key.  chosenDirectoryURL is the CA the admin
+// chose, only used if we don't know which one issued the certificate.
+func revokeCert(c context.Context, certID string, certPEM []byte, reason string, keyPEM privateKeyPEM, chosenDirectoryURL string) error {
+	reasonCode, ok := revocationReasons[reason]
+	if !ok {
+		return fmt.Errorf("Unknown revocation reason '%s'", reason)
+	}
+
+	block, _ := pem.Decode(certPEM)
+	if block == nil {
+		return fmt.Errorf("Certificate %s isn't PEM encoded", certID)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse certificate %s: %v", certID, err)
+	}
+
+	directoryURL, err := issuingDirectoryURL(c, certID, chosenDirectoryURL)
+	if err != nil {
+		return err
+	}
+
+	rev := &Revocation{
+		CertificateID: certID,
+		DomainNames:   cert.DNSNames,
+		SerialNumber:  fmt.Sprintf("%x", cert.SerialNumber),
+		Issuer:        cert.Issuer.CommonName,
+		DirectoryURL:  directoryURL,
+		Reason:        reason,
+	}
+
+	var client *acme.Client
+	var key crypto.Signer
+	if len(keyPEM) != 0 {
+		// The account isn't needed when the certificate key signs the request,
+		// so this works even if the key was compromised along with the account.
+		if key, err = parseCertKey(keyPEM); err != nil {
+			return fmt.Errorf("Invalid certificate private key: %v", err)
+		}
+		if pub, ok := key.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(cert.PublicKey) {
+			return fmt.Errorf("The private key doesn't belong to certificate %s", certID)
+		}
+		client = &acme.Client{
+			HTTPClient:   urlfetch.Client(c),
+			DirectoryURL: directoryURL,
+		}
+		rev.SignedWith = "certificate"
+	} else {
+		if client, _, err = createACMEClient(c, directoryURL); err != nil {
+			return fmt.Errorf("Failed to create ACME client: %v", err)
+		}
+		rev.SignedWith = "account"
+	}
+
+	log.Infof(c, "Revoking certificate %s (serial %s) with %s, reason %s, signed with the %s key",
+		certID, rev.SerialNumber, directoryURL, reason, rev.SignedWith)
+	if err := client.RevokeCert(c, key, block.Bytes, reasonCode); err != nil {
+		return fmt.Errorf("Failed to revoke certificate %s: %v", certID, err)
+	}
+
+	rev.Revoked = time.Now()
+	if err := rev.Put(c); err != nil {
+		return fmt.Errorf("Failed to save revocation: %v", err)
+	}
+	return nil
+}
+
+// issuingDirectoryURL returns the ACME directory that issued the certificate.
+// If we don't know, eg. because it was uploaded by hand, the admin has to
+// choose one rather than us guessing.
+func issuingDirectoryURL(c context.Context, certID, chosenDirectoryURL string) (string, error) {
+	uploaded, err := GetUploadedCertificate(c, certID)
+	switch {
+	case err == nil:
+		return uploaded.DirectoryURL, nil
+	case err != datastore.ErrNoSuchEntity:
+		return "", fmt.Errorf("Failed to get certificate %s: %v", certID, err)
+	case chosenDirectoryURL == "":
+		return "", fmt.Errorf("Don't know which CA issued certificate %s, please choose one", certID)
+	case !isValidDirectoryURL(chosenDirectoryURL):
+		return "", fmt.Errorf("Invalid ACME directory URL '%s'", chosenDirectoryURL)
+	}
+	return chosenDirectoryURL, nil
+}
+
+// revokeCA is a CA certificates of unknown origin can be revoked with.
+type revokeCA struct {
+	URL  string
+	Name string
+}
+
+// revokeCAs returns the CAs that can be chosen to revoke a certificate with:
+// the configured ones, then any others we know about.
+func revokeCAs(config *Config) []revokeCA {
+	var ret []revokeCA
+	seen := map[string]struct{}{}
+	add := func(directoryURL string) {
+		if _, ok := seen[directoryURL]; !ok {
+			seen[directoryURL] = struct{}{}
+			ret = append(ret, revokeCA{directoryURL, caName(directoryURL)})
+		}
+	}
+	for _, directoryURL := range config.DirectoryURLs() {
+		add(directoryURL)
+	}
+	for _, name := range []string{"production", "staging", "zerossl", "gts"} {
+		add(knownDirectories[name])
+	}
+	return ret
+}
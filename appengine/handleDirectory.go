@@ -0,0 +1,124 @@
+package appengine
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/log"
+)
+
+// knownDirectories are the ACME CAs that can be chosen on the status page
+// without entering a URL.
+var knownDirectories = map[string]string{
+	"production": acme.LetsEncryptURL,
+	"staging":    letsEncryptStagingURL,
+	"zerossl":    zeroSSLURL,
+	"gts":        googleTrustServicesURL,
+}
+
+// directoryChoice returns the knownDirectories name of the directory URL, or
+// "custom".
+func directoryChoice(directoryURL string) string {
+	for name, u := range knownDirectories {
+		if u == directoryURL {
+			return name
+		}
+	}
+	return "custom"
+}
+
+// isValidDirectoryURL reports whether s looks like an ACME directory URL.
+func isValidDirectoryURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "https" && u.Host != ""
+}
+
+// parseBudget returns the weekly budget from the form, or current if it was
+// left blank.
+func parseBudget(r *http.Request, name string, current int) (int, error) {
+	value := r.FormValue(name)
+	if value == "" {
+		return current, nil
+	}
+	budget, err := strconv.Atoi(value)
+	if err != nil || budget < 0 {
+		return 0, fmt.Errorf("Invalid %s '%s'", name, value)
+	}
+	return budget, nil
+}
+
+func handleDirectory(c context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("Invalid method %s", r.Method)
+	}
+
+	directory := r.FormValue("directory")
+	directoryURL, ok := knownDirectories[directory]
+	switch {
+	case ok:
+	case directory == "custom":
+		directoryURL = r.FormValue("customURL")
+		if !isValidDirectoryURL(directoryURL) {
+			return fmt.Errorf("Invalid ACME directory URL '%s'", directoryURL)
+		}
+	default:
+		return fmt.Errorf("Missing directory parameter")
+	}
+
+	// Fallbacks are given one per line, either by name or by URL.
+	var fallbackURLs []string
+	for _, line := range strings.Split(r.FormValue("fallbackURLs"), "\n") {
+		fallbackURL := strings.TrimSpace(line)
+		if known, ok := knownDirectories[fallbackURL]; ok {
+			fallbackURL = known
+		}
+		switch {
+		case fallbackURL == "" || fallbackURL == directoryURL || containsString(fallbackURLs, fallbackURL):
+			continue
+		case !isValidDirectoryURL(fallbackURL):
+			return fmt.Errorf("Invalid fallback ACME directory URL '%s'", fallbackURL)
+		}
+		fallbackURLs = append(fallbackURLs, fallbackURL)
+	}
+
+	if keyID := r.FormValue("eabKeyID"); keyID != "" {
+		hmacKey, err := decodeEABKey(r.FormValue("eabHMACKey"))
+		if err != nil {
+			return fmt.Errorf("Invalid EAB HMAC key: %v", err)
+		}
+		if len(hmacKey) == 0 {
+			return fmt.Errorf("Missing EAB HMAC key")
+		}
+		log.Infof(c, "Setting external account binding %s for %s", keyID, directoryURL)
+		if err := setExternalAccountBinding(c, directoryURL, keyID, hmacKey); err != nil {
+			return err
+		}
+	}
+
+	config, err := GetConfig(c)
+	if err != nil {
+		return err
+	}
+	config.DirectoryURL = directoryURL
+	config.FallbackDirectoryURLs = fallbackURLs
+	config.PreferredChain = strings.TrimSpace(r.FormValue("preferredChain"))
+	if config.CertsPerDomainBudget, err = parseBudget(r, "certsPerDomainBudget", config.CertsPerDomainBudget); err != nil {
+		return err
+	}
+	if config.DuplicateCertBudget, err = parseBudget(r, "duplicateCertBudget", config.DuplicateCertBudget); err != nil {
+		return err
+	}
+
+	log.Infof(c, "Switching to ACME directory %s", directoryURL)
+	if err := config.Put(c); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/ssl-certificates/status", http.StatusFound)
+	return nil
+}
@@ -1,65 +1,165 @@
 package appengine
 
 import (
-	"crypto/rand"
-	"crypto/rsa"
-	"crypto/x509"
-	"crypto/x509/pkix"
-	"encoding/asn1"
+	"crypto"
 	"fmt"
 	"time"
 
+	"golang.org/x/crypto/acme"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine/delay"
 	"google.golang.org/appengine/log"
 )
 
-var issueCertificateFunc = delay.Func("issue-certificate", func(c context.Context, cr *CreateOperation) error {
-	return updateOperation(c, cr, func() error {
-		client, _, err := createACMEClient(c)
-		if err != nil {
-			return fmt.Errorf("Failed to create ACME client: %v", err)
-		}
+// validateOrder waits for the CA to validate the challenges and then gets
+// the CSR ready.  A new private key is saved in datastore so the order can be
+// finalized again if we're interrupted.
+func validateOrder(c context.Context, cr *CreateOperation) error {
+	client, _, err := createACMEClient(c, cr.DirectoryURL)
+	if err != nil {
+		return fmt.Errorf("Failed to create ACME client: %v", err)
+	}
 
-		// Get the status of the challenge.
-		challenge, err := client.GetChallenge(c, cr.ChallengeURI)
-		if err != nil {
-			return fmt.Errorf("Failed to query challenge status: %v", err)
+	// Get the status of the order.
+	order, err := client.GetOrder(c, cr.OrderURI)
+	if err != nil {
+		return fmt.Errorf("Failed to query order status: %w", err)
+	}
+	switch order.Status {
+	case acme.StatusPending:
+		return fmt.Errorf("Order still pending, will retry later")
+	case acme.StatusInvalid:
+		cr.setError(invalidOrderError(c, client, cr, order))
+		cr.State = stateFailed
+		cleanupDNSRecords(c, cr)
+		return operationFinished // Don't retry.
+	case acme.StatusReady:
+		// Ready to be finalized.
+	default:
+		return fmt.Errorf("Order has unexpected status %s", order.Status)
+	}
+
+	// Remember the authorizations we just completed so they can be reused.
+	for _, a := range cr.Authorizations {
+		if a.ChallengeURI == "" {
+			continue
 		}
-		switch challenge.Status {
-		case "pending":
-			return fmt.Errorf("Challenge still pending, will retry later")
-		case "invalid":
-			fmt.Errorf("Challenge is invalid: %v", challenge.Error)
-			return operationFinished // Don't retry.
+		if auth, err := client.GetAuthorization(c, a.URI); err != nil {
+			log.Warningf(c, "Failed to get authorization for %s: %v", a.HostName, err)
+		} else {
+			cacheAuthorization(c, client, auth)
 		}
+	}
 
-		// Create a new key for this certificate.
-		certKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	// Use the CSR we were given, or create a new key for this certificate.
+	if cr.ProvidedCSR == nil {
+		certKey, err := generateCertKey(cr.KeyType)
+		if err != nil {
+			return fmt.Errorf("Failed to generate %s private key: %v", cr.KeyType, err)
+		}
+		keyPEM, err := marshalCertKey(certKey)
 		if err != nil {
-			return fmt.Errorf("Failed to generate RSA private key: %v", err)
+			return fmt.Errorf("Failed to PEM-encode private key: %v", err)
+		}
+		if err := PutCertificateKey(c, cr.OrderURI, keyPEM); err != nil {
+			return fmt.Errorf("Failed to save private key: %v", err)
 		}
+	}
+
+	cr.State = stateFinalizing
+	return nil
+}
 
-		// Create the CSR.
-		asn1Subj, _ := asn1.Marshal(pkix.Name{CommonName: cr.HostName}.ToRDNSequence())
-		csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
-			RawSubject:         asn1Subj,
-			SignatureAlgorithm: x509.SHA256WithRSA,
-		}, certKey)
+// finalizeOrder submits the CSR and downloads the certificate.  If the order
+// was already finalized the certificate is just downloaded.
+func finalizeOrder(c context.Context, cr *CreateOperation) error {
+	client, _, err := createACMEClient(c, cr.DirectoryURL)
+	if err != nil {
+		return fmt.Errorf("Failed to create ACME client: %v", err)
+	}
+
+	var certKey crypto.Signer
+	csr := cr.ProvidedCSR
+	if csr == nil {
+		keyPEM, err := GetCertificateKey(c, cr.OrderURI)
 		if err != nil {
+			return fmt.Errorf("Failed to get private key: %v", err)
+		}
+		if certKey, err = parseCertKey(keyPEM); err != nil {
+			return fmt.Errorf("Failed to parse private key: %v", err)
+		}
+		if csr, err = createCSR(cr, certKey); err != nil {
 			return fmt.Errorf("Failed to create CSR: %v", err)
 		}
+	}
 
-		// Try to issue a certificate with it.
-		chain, url, err := client.CreateCert(c, csr, 90*24*time.Hour, true)
-		if err != nil {
-			return fmt.Errorf("Failed to create certificate: %v", err)
+	order, err := client.GetOrder(c, cr.OrderURI)
+	if err != nil {
+		return fmt.Errorf("Failed to query order status: %w", err)
+	}
+
+	var chain [][]byte
+	var url string
+	switch order.Status {
+	case acme.StatusReady:
+		cr.Finalized = time.Now()
+		if chain, url, err = client.CreateOrderCert(c, order.FinalizeURL, csr, true); err != nil {
+			return fmt.Errorf("Failed to create certificate: %w", err)
+		}
+	case acme.StatusProcessing, acme.StatusValid:
+		// We finalized the order before being interrupted.
+		if order, err = client.WaitOrder(c, cr.OrderURI); err != nil {
+			return fmt.Errorf("Failed to wait for order: %w", err)
+		}
+		url = order.CertURL
+		if chain, err = client.FetchCert(c, url, true); err != nil {
+			return fmt.Errorf("Failed to fetch certificate: %w", err)
 		}
-		log.Infof(c, "Got %d DER blocks for certificate %s", len(chain), url)
+	case acme.StatusInvalid:
+		cr.setError(invalidOrderError(c, client, cr, order))
+		cr.State = stateFailed
+		cleanupDNSRecords(c, cr)
+		return operationFinished // Don't retry.
+	default:
+		return fmt.Errorf("Order has unexpected status %s", order.Status)
+	}
+	log.Infof(c, "Got %d DER blocks for certificate %s", len(chain), url)
+
+	// Use the chain leading to the preferred root, if there's a choice.
+	if config, err := GetConfig(c); err != nil {
+		log.Warningf(c, "Failed to get config, using the default chain: %v", err)
+	} else {
+		chain = selectChain(c, client, url, chain, config.PreferredChain)
+	}
+	cr.ChainIssuers, _ = chainIssuers(chain)
+	cleanupDNSRecords(c, cr)
+
+	cr.CertificateURI = url
+	cr.Issued = time.Now()
+	recordIssuance(c, cr)
+
+	if certKey == nil {
+		// We don't have the key, so keep the chain for whoever gave us the
+		// CSR to download.
+		if err := saveCSRCertificate(c, cr, chain); err != nil {
+			return err
+		}
+		cr.State = stateDone
+		return nil
+	}
+
+	if cr.Chain, err = pemEncode(certificatePEMType, chain); err != nil {
+		return fmt.Errorf("Failed to PEM-encode certificate chain: %v", err)
+	}
 
-		cr.Issued = time.Now()
+	// Upload it to the cloud console.
+	cr.State = stateUploading
+	return nil
+}
 
-		// Upload it to the cloud console.
-		return delayFunc(c, uploadCertFunc, cr, serializeKey(certKey), chain)
-	})
+// legacyIssueCertificateFunc runs tasks queued by versions before operations
+// could be resumed, which would otherwise fail to decode and use up their
+// retries.
+var legacyIssueCertificateFunc = delay.Func("issue-certificate", func(c context.Context, cr *CreateOperation) error {
+	return resumeLegacyOperation(c, cr.OrderURI, stateValidating, nil)
 })
@@ -1,7 +1,10 @@
 package appengine
 
 import (
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"strings"
 	"time"
 
 	"golang.org/x/net/context"
@@ -12,30 +15,102 @@ import (
 	aeapi "google.golang.org/api/appengine/v1beta"
 )
 
-var mapCertFunc = delay.Func("map-certificate",
-	func(c context.Context, cr *CreateOperation, certID, domain string) error {
-		return updateOperation(c, cr, func() error {
-			apps, err := createAppengineClient(c)
-			if err != nil {
-				return fmt.Errorf("Failed to create appengine client: %v", err)
-			}
-
-			// Make the certificate the default for the domain.
-			log.Infof(c, "Making certificate ID %s the default for domain %s", certID, domain)
-			req := apps.DomainMappings.Patch(appengine.AppID(c), domain, &aeapi.DomainMapping{
-				SslSettings: &aeapi.SslSettings{
-					CertificateId: certID,
-				},
-			})
-			req.UpdateMask("sslSettings.certificateId")
-			if _, err := req.Do(); err != nil {
-				return fmt.Errorf("Failed to map certificate: %v", err)
-			}
-
-			cr.Mapped = time.Now()
-			cr.MappedCertificateID = certID
-
-			log.Infof(c, "Success!")
-			return operationFinished
+// mapCert makes the uploaded certificate the default for every domain it
+// covers.
+func mapCert(c context.Context, cr *CreateOperation) error {
+	apps, err := createAppengineClient(c)
+	if err != nil {
+		return fmt.Errorf("Failed to create appengine client: %v", err)
+	}
+	project := appengine.AppID(c)
+
+	// Remember which CA issued the certificate before it's in use, so it's
+	// renewed and revoked with the same one.
+	if err := saveUploadedCertificate(c, cr); err != nil {
+		return err
+	}
+
+	resp, err := apps.DomainMappings.List(project).Do()
+	if err != nil {
+		return fmt.Errorf("Failed to list domain mappings: %v", err)
+	}
+
+	var mapped int
+	for _, domain := range resp.DomainMappings {
+		if !coversHostName(cr.AllHostNames(), domain.Id) {
+			continue
+		}
+
+		log.Infof(c, "Making certificate ID %s the default for domain %s", cr.CertificateID, domain.Id)
+		req := apps.DomainMappings.Patch(project, domain.Id, &aeapi.DomainMapping{
+			SslSettings: &aeapi.SslSettings{
+				CertificateId: cr.CertificateID,
+			},
+		})
+		req.UpdateMask("sslSettings.certificateId")
+		if _, err := req.Do(); err != nil {
+			return fmt.Errorf("Failed to map certificate to %s: %v", domain.Id, err)
+		}
+		mapped++
+	}
+	if mapped == 0 {
+		return fmt.Errorf("No domain mappings are covered by %s", strings.Join(cr.AllHostNames(), ", "))
+	}
+
+	cr.Mapped = time.Now()
+	cr.MappedCertificateID = cr.CertificateID
+
+	// App Engine has the private key now, we don't need to keep it.
+	if err := DeleteCertificateKey(c, cr.OrderURI); err != nil {
+		log.Warningf(c, "Failed to delete private key for %s: %v", cr.HostName, err)
+	}
+	cr.State = stateDone
+
+	log.Infof(c, "Success!")
+	return nil
+}
+
+// saveUploadedCertificate records the operation's uploaded certificate.
+func saveUploadedCertificate(c context.Context, cr *CreateOperation) error {
+	uc := &UploadedCertificate{
+		HostNames:    cr.AllHostNames(),
+		DirectoryURL: cr.DirectoryURL,
+		OrderURI:     cr.OrderURI,
+	}
+	if block, _ := pem.Decode(cr.Chain); block != nil {
+		if cert, err := x509.ParseCertificate(block.Bytes); err == nil {
+			uc.Expiry = cert.NotAfter
+		}
+	}
+	if err := uc.Put(c, cr.CertificateID); err != nil {
+		return fmt.Errorf("Failed to save certificate %s: %v", cr.CertificateID, err)
+	}
+	return nil
+}
+
+// coversHostName reports whether a certificate for the given names is valid
+// for hostname.  A wildcard name covers exactly one extra label.
+func coversHostName(names []string, hostname string) bool {
+	for _, name := range names {
+		if name == hostname {
+			return true
+		}
+		if !strings.HasPrefix(name, "*.") {
+			continue
+		}
+		if i := strings.Index(hostname, "."); i != -1 && hostname[i+1:] == name[2:] {
+			return true
+		}
+	}
+	return false
+}
+
+// legacyMapCertFunc runs tasks queued by versions before operations could be
+// resumed, which would otherwise fail to decode and use up their retries.
+var legacyMapCertFunc = delay.Func("map-certificate",
+	func(c context.Context, cr *CreateOperation, certID string) error {
+		return resumeLegacyOperation(c, cr.OrderURI, stateMapping, func(cr *CreateOperation) error {
+			cr.CertificateID = certID
+			return nil
 		})
 	})
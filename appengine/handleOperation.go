@@ -0,0 +1,42 @@
+package appengine
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/flosch/pongo2"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+)
+
+var (
+	tplOperation = loadTemplate("operation.html")
+)
+
+// handleOperation shows an operation and the log of every step it ran.
+func handleOperation(c context.Context, w http.ResponseWriter, r *http.Request) error {
+	orderURI := r.FormValue("order")
+	if orderURI == "" {
+		return fmt.Errorf("Missing order")
+	}
+
+	cr, err := GetCreateOperation(c, orderURI)
+	if err != nil {
+		return fmt.Errorf("Failed to get operation: %v", err)
+	}
+	events, err := GetOperationEvents(c, orderURI)
+	if err != nil {
+		return fmt.Errorf("Failed to get events: %v", err)
+	}
+	responded, err := LastResponded(c, cr)
+	if err != nil {
+		return fmt.Errorf("Failed to get challenges: %v", err)
+	}
+
+	return tplOperation.ExecuteWriter(pongo2.Context{
+		"project":   appengine.AppID(c),
+		"operation": cr,
+		"events":    events,
+		"responded": responded,
+	}, w)
+}
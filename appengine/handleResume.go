@@ -0,0 +1,29 @@
+package appengine
+
+import (
+	"fmt"
+	"net/http"
+
+	"golang.org/x/net/context"
+)
+
+// handleResume resumes an operation that failed partway through.
+func handleResume(c context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("Invalid method %s", r.Method)
+	}
+
+	cr, err := GetCreateOperation(c, r.FormValue("order"))
+	if err != nil {
+		return fmt.Errorf("Failed to get operation: %v", err)
+	}
+	if !cr.IsResumable() {
+		return fmt.Errorf("The operation for %s can't be resumed", cr.HostName)
+	}
+	if err := resumeOperation(c, cr); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/ssl-certificates/status", http.StatusFound)
+	return nil
+}
@@ -0,0 +1,67 @@
+package appengine
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+func handleRollover(c context.Context, w http.ResponseWriter, r *http.Request) error {
+	if r.Method != "POST" {
+		return fmt.Errorf("Invalid method %s", r.Method)
+	}
+
+	config, err := GetConfig(c)
+	if err != nil {
+		return err
+	}
+	if err := rolloverAccountKey(c, config.DirectoryURL); err != nil {
+		return err
+	}
+
+	http.Redirect(w, r, "/ssl-certificates/status", http.StatusFound)
+	return nil
+}
+
+// rolloverAccountKey replaces the key of the account registered with the given
+// ACME directory, remembering the fingerprint of the old one.
+func rolloverAccountKey(c context.Context, directoryURL string) error {
+	client, account, err := createACMEClient(c, directoryURL)
+	if err != nil {
+		return fmt.Errorf("Failed to create ACME client: %v", err)
+	}
+	oldFingerprint := account.KeyFingerprint()
+
+	newKey, err := generateAccountKey(c)
+	if err != nil {
+		return err
+	}
+
+	// Encrypt the new key before the CA accepts it, so a failure to encrypt it
+	// doesn't leave the CA expecting a key we can't store.  It's only saved
+	// once the CA has accepted it.
+	if err := account.setKey(c, newKey); err != nil {
+		return err
+	}
+
+	log.Infof(c, "Rolling over key %s of account %s", oldFingerprint, account.AccountID)
+	if err := client.AccountKeyRollover(c, newKey); err != nil {
+		return fmt.Errorf("Failed to roll over account key: %v", err)
+	}
+
+	// The CA only accepts the new key now, so it has to be saved.
+	account.PreviousKeys = append(account.PreviousKeys, PreviousAccountKey{
+		Fingerprint: oldFingerprint,
+		RolledOver:  time.Now(),
+	})
+	if _, err := datastore.Put(c, registeredAccountKey(c, directoryURL), account); err != nil {
+		log.Criticalf(c, "Failed to save new key of account %s: %v", account.AccountID, err)
+		return fmt.Errorf("Failed to save new account key: %v", err)
+	}
+	log.Infof(c, "Account %s now uses key %s", account.AccountID, account.KeyFingerprint())
+	return nil
+}
@@ -0,0 +1,98 @@
+package appengine
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/flosch/pongo2"
+	"golang.org/x/net/context"
+	"google.golang.org/appengine"
+	"google.golang.org/appengine/log"
+)
+
+var (
+	tplSettings = loadTemplate("settings.html")
+)
+
+func handleSettings(c context.Context, w http.ResponseWriter, r *http.Request) error {
+	hostname := r.FormValue("hostname")
+	if hostname == "" {
+		return fmt.Errorf("Missing hostname parameter")
+	}
+
+	settings, err := GetDomainSettings(c, hostname)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == "POST" {
+		settings.ChallengeType = r.FormValue("challengeType")
+		settings.DNSProvider = r.FormValue("dnsProvider")
+		settings.KeyType = r.FormValue("keyType")
+		settings.Profile = strings.TrimSpace(r.FormValue("profile"))
+		settings.CSR = CSROptions{
+			MustStaple:         r.FormValue("mustStaple") != "",
+			OmitCommonName:     r.FormValue("omitCommonName") != "",
+			Organization:       strings.TrimSpace(r.FormValue("organization")),
+			OrganizationalUnit: strings.TrimSpace(r.FormValue("organizationalUnit")),
+			Locality:           strings.TrimSpace(r.FormValue("locality")),
+			Province:           strings.TrimSpace(r.FormValue("province")),
+			Country:            strings.TrimSpace(r.FormValue("country")),
+		}
+		if days := r.FormValue("validityDays"); days == "" {
+			settings.ValidityDays = 0
+		} else if settings.ValidityDays, err = strconv.Atoi(days); err != nil || settings.ValidityDays < 0 {
+			return fmt.Errorf("Invalid validity '%s'", days)
+		}
+		settings.CloudDNSProject = r.FormValue("cloudDNSProject")
+		settings.RFC2136Nameserver = r.FormValue("rfc2136Nameserver")
+		settings.RFC2136TSIGKeyName = r.FormValue("rfc2136TSIGKeyName")
+		settings.RFC2136TSIGAlgorithm = r.FormValue("rfc2136TSIGAlgorithm")
+		if secret := r.FormValue("rfc2136TSIGSecret"); secret != "" {
+			// Leaving the secret blank keeps the existing one.
+			settings.RFC2136TSIGSecret = secret
+		}
+
+		switch settings.ChallengeType {
+		case challengeTypeHTTP:
+		case challengeTypeDNS:
+			if _, err := newDNSProvider(c, settings); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unknown challenge type '%s'", settings.ChallengeType)
+		}
+
+		switch settings.KeyType {
+		case keyTypeRSA2048, keyTypeRSA3072, keyTypeRSA4096, keyTypeECDSAP256:
+		default:
+			return fmt.Errorf("Unknown key type '%s'", settings.KeyType)
+		}
+
+		log.Infof(c, "Saving settings for %s", hostname)
+		if err := settings.Put(c, hostname); err != nil {
+			return err
+		}
+		http.Redirect(w, r, "/ssl-certificates/status", http.StatusFound)
+		return nil
+	}
+
+	// Offer the profiles of the CA currently selected.
+	var profiles map[string]string
+	if config, err := GetConfig(c); err != nil {
+		log.Warningf(c, "Failed to get config: %v", err)
+	} else if dir, err := fetchDirectoryExtensions(c, config.DirectoryURL); err != nil {
+		log.Warningf(c, "Failed to get certificate profiles: %v", err)
+	} else {
+		profiles = dir.Meta.Profiles
+	}
+
+	return tplSettings.ExecuteWriter(pongo2.Context{
+		"project":  appengine.AppID(c),
+		"hostname": hostname,
+		"settings": settings,
+		"profiles": profiles,
+	}, w)
+}
@@ -3,6 +3,7 @@ package appengine
 import (
 	"crypto/x509"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/davidsansome/parallel"
 	"github.com/flosch/pongo2"
+	"golang.org/x/crypto/acme"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/log"
@@ -21,7 +23,7 @@ import (
 )
 
 var (
-	tplStatus = pongo2.Must(pongo2.FromFile("status.html"))
+	tplStatus = loadTemplate("status.html")
 )
 
 const (
@@ -45,6 +47,13 @@ func handleStatus(c context.Context, w http.ResponseWriter, r *http.Request) err
 	authorizedDomains := map[string]struct{}{}
 	var domainMappings []*aeapi.DomainMapping
 	var account *RegisteredAccount
+	var accountErr error
+	var termsChanged bool
+	var revocations []*Revocation
+	var renewalWindows map[string]*RenewalWindow
+	var uploaded map[string]*UploadedCertificate
+	var csrCerts []*CSRCertificate
+	var config *Config
 	var acmeTest error
 
 	if err := parallel.Parallel(nil, nil, func() error {
@@ -76,9 +85,52 @@ func handleStatus(c context.Context, w http.ResponseWriter, r *http.Request) err
 		}
 		return nil
 	}, func() error {
-		// Get the registered ACME account.
+		// Get the registered ACME account.  Show any errors on the page so a
+		// different CA can still be chosen.
 		var err error
-		_, account, err = createACMEClient(c)
+		if config, err = GetConfig(c); err != nil {
+			return err
+		}
+		var client *acme.Client
+		client, account, accountErr = createACMEClient(c, config.DirectoryURL)
+		var termsErr *termsError
+		if errors.As(accountErr, &termsErr) {
+			// Not registered until the Terms of Service are agreed to.
+			account, accountErr = GetRegisteredAccount(c, config.DirectoryURL)
+			termsChanged = true
+			return nil
+		}
+		if accountErr != nil {
+			log.Errorf(c, "Failed to get ACME account: %v", accountErr)
+			return nil
+		}
+
+		// Prompt for the Terms of Service to be agreed to again if they changed.
+		if dir, err := client.Discover(c); err != nil {
+			log.Warningf(c, "Failed to get ACME directory: %v", err)
+		} else {
+			termsChanged = dir.Terms != "" && dir.Terms != account.TermsAgreed
+		}
+		return nil
+	}, func() error {
+		// Get when the CA suggested renewing each domain.
+		var err error
+		renewalWindows, err = GetAllRenewalWindows(c)
+		return err
+	}, func() error {
+		// Get which CA issued each certificate.
+		var err error
+		uploaded, err = GetAllUploadedCertificates(c)
+		return err
+	}, func() error {
+		// Get certificates issued for CSRs we were given.
+		var err error
+		csrCerts, err = GetCSRCertificates(c)
+		return err
+	}, func() error {
+		// Get revoked certificates.
+		var err error
+		revocations, err = GetRevocations(c)
 		return err
 	}, func() error {
 		// Get ongoing operations.
@@ -100,17 +152,50 @@ func handleStatus(c context.Context, w http.ResponseWriter, r *http.Request) err
 		Name         string
 		Cert         *certInfo
 		Operation    *CreateOperation
+		Renewal      *RenewalWindow // Only set if it's for the current cert.
 		IsAuthorized bool
+		CanCreate    bool // Whether a new certificate can be requested now.
+
+		// When the CA's authorization for this domain expires, if it has one.
+		AuthorizedUntil time.Time
+
+		// How many more certificates the CA can issue for the domain's
+		// registered domain this week, or -1 if there's no budget.
+		RegisteredDomain string
+		BudgetRemaining  int
 	}
 	var domains []domainData
 
+	// Find which domains the CA will issue for without new challenges.
+	authorizedUntil := map[string]time.Time{}
+	if account != nil {
+		cached, err := GetCachedAuthorizations(c, config.DirectoryURL, account.AccountID)
+		if err != nil {
+			return err
+		}
+		for _, auth := range cached {
+			if auth.Expires.After(authorizedUntil[auth.HostName]) {
+				authorizedUntil[auth.HostName] = auth.Expires
+			}
+		}
+	}
+
+	// Find how many more certificates the CA will give each domain this week.
+	budget, err := loadIssuanceBudget(c, config, config.DirectoryURL)
+	if err != nil {
+		return err
+	}
+
 	usedCertIDs := map[string]struct{}{}
 	var anyNotAuthorized bool
 	var anyOngoing bool
 	for _, domain := range domainMappings {
 		d := domainData{
-			Name:         domain.Id,
-			IsAuthorized: isAuthorizedSubdomain(domain.Id, authorizedDomains),
+			Name:             domain.Id,
+			IsAuthorized:     isAuthorizedSubdomain(domain.Id, authorizedDomains),
+			AuthorizedUntil:  authorizedUntil[domain.Id],
+			RegisteredDomain: registeredDomain(domain.Id),
+			BudgetRemaining:  budget.Remaining(domain.Id),
 		}
 		if !d.IsAuthorized {
 			anyNotAuthorized = true
@@ -123,7 +208,10 @@ func handleStatus(c context.Context, w http.ResponseWriter, r *http.Request) err
 
 			// Find a cert with this ID.
 			if cert, ok := certs[certID]; ok {
-				d.Cert = makeCertInfo(cert)
+				d.Cert = makeCertInfo(cert, uploaded[cert.Id])
+			}
+			if window, ok := renewalWindows[domain.Id]; ok && window.CertificateID == certID {
+				d.Renewal = window
 			}
 		}
 
@@ -134,6 +222,7 @@ func handleStatus(c context.Context, w http.ResponseWriter, r *http.Request) err
 				anyOngoing = true
 			}
 		}
+		d.CanCreate = d.IsAuthorized && !d.Operation.IsOngoing()
 
 		domains = append(domains, d)
 	}
@@ -142,7 +231,7 @@ func handleStatus(c context.Context, w http.ResponseWriter, r *http.Request) err
 	var unusedCerts []*certInfo
 	for id, cert := range certs {
 		if _, ok := usedCertIDs[id]; !ok {
-			unusedCerts = append(unusedCerts, makeCertInfo(cert))
+			unusedCerts = append(unusedCerts, makeCertInfo(cert, uploaded[cert.Id]))
 		}
 	}
 	sort.Slice(unusedCerts, func(i, j int) bool {
@@ -150,11 +239,20 @@ func handleStatus(c context.Context, w http.ResponseWriter, r *http.Request) err
 	})
 
 	return tplStatus.ExecuteWriter(pongo2.Context{
-		"project":        project,
-		"account":        account,
-		"domains":        domains,
-		"serviceAccount": serviceAccount,
-		"unusedCerts":    unusedCerts,
+		"project":         project,
+		"account":         account,
+		"accountError":    accountErr,
+		"termsChanged":    termsChanged,
+		"directoryURL":    config.DirectoryURL,
+		"directoryChoice": directoryChoice(config.DirectoryURL),
+		"fallbackURLs":    config.FallbackDirectoryURLs,
+		"revokeCAs":       revokeCAs(config),
+		"config":          config,
+		"domains":         domains,
+		"serviceAccount":  serviceAccount,
+		"unusedCerts":     unusedCerts,
+		"revocations":     revocations,
+		"csrCerts":        csrCerts,
 
 		"anyNotAuthorized": anyNotAuthorized,
 		"anyOngoing":       anyOngoing,
@@ -171,17 +269,33 @@ type certInfo struct {
 	DomainNames []string
 	Expiry      time.Time
 
-	Issuer string
-	Issue  time.Time
+	Issuer       string
+	Issue        time.Time
+	KeyAlgorithm string
+	Chain        []string // Issuer of each certificate in the chain.
+	DirectoryURL string   // ACME directory that issued it, if we know.
 }
 
-func makeCertInfo(raw *aeapi.AuthorizedCertificate) *certInfo {
+// CAName returns the name of the CA that issued the certificate, if we know.
+func (ci *certInfo) CAName() string {
+	if ci.DirectoryURL == "" {
+		return ""
+	}
+	return caName(ci.DirectoryURL)
+}
+
+// makeCertInfo describes a certificate.  uploaded is our record of it, or nil
+// if it was uploaded by someone else or before we kept records.
+func makeCertInfo(raw *aeapi.AuthorizedCertificate, uploaded *UploadedCertificate) *certInfo {
 	ret := certInfo{
 		Name:        raw.Name,
 		ID:          raw.Id,
 		DisplayName: raw.DisplayName,
 		DomainNames: raw.DomainNames,
 	}
+	if uploaded != nil {
+		ret.DirectoryURL = uploaded.DirectoryURL
+	}
 	ret.Expiry, _ = time.Parse(expireTimeFormat, raw.ExpireTime)
 
 	// Parse the PEM to get the issuer.  We only need the first block.
@@ -190,8 +304,10 @@ func makeCertInfo(raw *aeapi.AuthorizedCertificate) *certInfo {
 		if err == nil && cert != nil {
 			ret.Issuer = cert.Issuer.CommonName
 			ret.Issue = cert.NotBefore
+			ret.KeyAlgorithm = keyAlgorithm(cert.PublicKey)
 		}
 	}
+	ret.Chain = pemChainIssuers([]byte(raw.CertificateRawData.PublicCertificate))
 
 	return &ret
 }
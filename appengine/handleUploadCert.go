@@ -2,6 +2,7 @@ package appengine
 
 import (
 	"crypto/x509"
+	"encoding/pem"
 	"fmt"
 	"strings"
 	"time"
@@ -27,51 +28,74 @@ func createAppengineClient(c context.Context) (*aeapi.AppsService, error) {
 	return apps.Apps, err
 }
 
-var uploadCertFunc = delay.Func("upload-certificate",
-	func(c context.Context, cr *CreateOperation, key []byte, chain [][]byte) error {
-		return updateOperation(c, cr, func() error {
-			apps, err := createAppengineClient(c)
-			if err != nil {
-				return fmt.Errorf("Failed to create appengine client: %v", err)
-			}
+// uploadCert uploads the operation's certificate and private key to App
+// Engine.
+func uploadCert(c context.Context, cr *CreateOperation) error {
+	apps, err := createAppengineClient(c)
+	if err != nil {
+		return fmt.Errorf("Failed to create appengine client: %v", err)
+	}
 
-			// The first certificate in the chain is ours.  Use it to make a display name.
-			certs, err := x509.ParseCertificates(chain[0])
-			if err != nil {
-				return fmt.Errorf("Failed to parse certificate: %v", err)
-			}
+	// The first certificate in the chain is ours.  Use it to make a display name.
+	block, _ := pem.Decode(cr.Chain)
+	if block == nil {
+		return fmt.Errorf("Operation has no certificate")
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return fmt.Errorf("Failed to parse certificate: %v", err)
+	}
 
-			displayName := fmt.Sprintf("cert-%s-%x",
-				strings.Replace(certs[0].Subject.CommonName, ".", "-", -1),
-				certs[0].SerialNumber)
+	// Certificates without a common name are named after the primary
+	// hostname it would have been.
+	name := cert.Subject.CommonName
+	if name == "" {
+		name = cr.HostName
+	}
+	displayName := fmt.Sprintf("cert-%s-%x",
+		strings.Replace(name, ".", "-", -1),
+		cert.SerialNumber)
 
-			// PEM-encode both the private key and the certificate chain.
-			keyPEM, err := pemEncode(privateKeyPEMType, [][]byte{key})
-			if err != nil {
-				return fmt.Errorf("Failed to PEM-encode private key: %v", err)
-			}
-			certPEM, err := pemEncode(certificatePEMType, chain)
-			if err != nil {
-				return fmt.Errorf("Failed to PEM-encode certificates: %v", err)
-			}
+	keyPEM, err := GetCertificateKey(c, cr.OrderURI)
+	if err != nil {
+		return fmt.Errorf("Failed to get private key: %v", err)
+	}
 
-			// Upload the certificate.
-			log.Infof(c, "Uploading certificate %s", displayName)
-			log.Debugf(c, "%s\n%s", keyPEM, certPEM)
-			resp, err := apps.AuthorizedCertificates.Create(appengine.AppID(c), &aeapi.AuthorizedCertificate{
-				CertificateRawData: &aeapi.CertificateRawData{
-					PublicCertificate: string(certPEM),
-					PrivateKey:        string(keyPEM),
-				},
-				DisplayName: displayName,
-			}).Do()
-			if err != nil {
-				return fmt.Errorf("Failed to upload certificate: %v", err)
-			}
-			log.Infof(c, "Successfully uploaded %s", resp.Name)
+	// Upload the certificate.  The chain and private key are already
+	// PEM-encoded.
+	log.Infof(c, "Uploading certificate %s", displayName)
+	resp, err := apps.AuthorizedCertificates.Create(appengine.AppID(c), &aeapi.AuthorizedCertificate{
+		CertificateRawData: &aeapi.CertificateRawData{
+			PublicCertificate: string(cr.Chain),
+			PrivateKey:        string(keyPEM),
+		},
+		DisplayName: displayName,
+	}).Do()
+	if err != nil {
+		return fmt.Errorf("Failed to upload certificate: %v", err)
+	}
+	log.Infof(c, "Successfully uploaded %s", resp.Name)
 
-			cr.Uploaded = time.Now()
+	cr.Uploaded = time.Now()
+	cr.CertificateID = resp.Id
+	cr.State = stateMapping
+	return nil
+}
 
-			return delayFunc(c, mapCertFunc, cr, resp.Id, certs[0].Subject.CommonName)
+// legacyUploadCertFunc runs tasks queued by versions before operations could
+// be resumed, which would otherwise fail to decode and use up their retries.
+// Those passed the key and DER chain to the task rather than saving them.
+var legacyUploadCertFunc = delay.Func("upload-certificate",
+	func(c context.Context, cr *CreateOperation, keyPEM []byte, chain [][]byte) error {
+		return resumeLegacyOperation(c, cr.OrderURI, stateUploading, func(cr *CreateOperation) error {
+			if err := PutCertificateKey(c, cr.OrderURI, keyPEM); err != nil {
+				return fmt.Errorf("Failed to save private key: %v", err)
+			}
+			chainPEM, err := pemEncode(certificatePEMType, chain)
+			if err != nil {
+				return err
+			}
+			cr.Chain = chainPEM
+			return nil
 		})
 	})
@@ -0,0 +1,220 @@
+package appengine
+
+import (
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+const (
+	keyTypeRSA2048   = "rsa2048"
+	keyTypeRSA3072   = "rsa3072"
+	keyTypeRSA4096   = "rsa4096"
+	keyTypeECDSAP256 = "ecdsa-p256"
+
+	defaultKeyType = keyTypeRSA2048
+
+	ecPrivateKeyPEMType    = "EC PRIVATE KEY"
+	pkcs8PrivateKeyPEMType = "PRIVATE KEY"
+)
+
+// generateCertKey creates a new private key for a certificate.
+func generateCertKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case "", keyTypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case keyTypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case keyTypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case keyTypeECDSAP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return nil, fmt.Errorf("Unknown key type '%s'", keyType)
+	}
+}
+
+// signatureAlgorithm returns the algorithm to sign a CSR with the given key.
+func signatureAlgorithm(key crypto.Signer) x509.SignatureAlgorithm {
+	if _, ok := key.Public().(*ecdsa.PublicKey); ok {
+		return x509.ECDSAWithSHA256
+	}
+	return x509.SHA256WithRSA
+}
+
+// marshalCertKey PEM-encodes a certificate's private key in the format the App
+// Engine Admin API expects: PKCS#1 for RSA keys and SEC 1 for ECDSA keys.
+func marshalCertKey(key crypto.Signer) ([]byte, error) {
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		return pemEncode(privateKeyPEMType, [][]byte{x509.MarshalPKCS1PrivateKey(k)})
+	case *ecdsa.PrivateKey:
+		der, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return nil, err
+		}
+		return pemEncode(ecPrivateKeyPEMType, [][]byte{der})
+	default:
+		return nil, fmt.Errorf("Unsupported private key type %T", key)
+	}
+}
+
+// parseCertKey parses a PEM-encoded certificate private key in PKCS#1, SEC 1
+// or PKCS#8 format.
+func parseCertKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("No PEM data found")
+	}
+	switch block.Type {
+	case privateKeyPEMType:
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	case ecPrivateKeyPEMType:
+		return x509.ParseECPrivateKey(block.Bytes)
+	case pkcs8PrivateKeyPEMType:
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		signer, ok := key.(crypto.Signer)
+		if !ok {
+			return nil, fmt.Errorf("Unsupported private key type %T", key)
+		}
+		return signer, nil
+	default:
+		return nil, fmt.Errorf("Unsupported PEM block type '%s'", block.Type)
+	}
+}
+
+// parseAccountKey parses an ACME account key exported from another client,
+// either PEM-encoded (certbot's and lego's key files) or as a JWK (certbot's
+// private_key.json).
+func parseAccountKey(data []byte) (crypto.Signer, error) {
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "{") {
+		return parseJWK(data)
+	}
+	return parseCertKey(data)
+}
+
+// jwk is a JSON Web Key (RFC 7517) holding an RSA or EC private key.
+type jwk struct {
+	Kty string `json:"kty"`
+
+	// RSA.
+	N  string `json:"n"`
+	E  string `json:"e"`
+	D  string `json:"d"`
+	P  string `json:"p"`
+	Q  string `json:"q"`
+	Dp string `json:"dp"`
+	Dq string `json:"dq"`
+	Qi string `json:"qi"`
+
+	// EC.
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWK parses an RSA or P-256 ECDSA private key from a JWK.
+func parseJWK(data []byte) (crypto.Signer, error) {
+	var k jwk
+	if err := json.Unmarshal(data, &k); err != nil {
+		return nil, fmt.Errorf("Invalid JWK: %v", err)
+	}
+
+	// Decode the base64url integers, stopping at the first missing or invalid
+	// one.
+	var err error
+	num := func(name, value string) *big.Int {
+		if err != nil {
+			return nil
+		}
+		var b []byte
+		if value == "" {
+			err = fmt.Errorf("JWK is missing '%s'", name)
+		} else if b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "=")); err != nil {
+			err = fmt.Errorf("Invalid JWK '%s': %v", name, err)
+		}
+		return new(big.Int).SetBytes(b)
+	}
+
+	switch k.Kty {
+	case "RSA":
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: num("n", k.N)},
+			D:         num("d", k.D),
+			Primes:    []*big.Int{num("p", k.P), num("q", k.Q)},
+		}
+		e := num("e", k.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() > 1<<31-1 {
+			return nil, fmt.Errorf("Invalid JWK RSA exponent")
+		}
+		key.E = int(e.Int64())
+		if err := key.Validate(); err != nil {
+			return nil, fmt.Errorf("Invalid JWK RSA key: %v", err)
+		}
+		key.Precompute()
+		return key, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("Unsupported JWK curve '%s'", k.Crv)
+		}
+		key := &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     num("x", k.X),
+				Y:     num("y", k.Y),
+			},
+			D: num("d", k.D),
+		}
+		if err != nil {
+			return nil, err
+		}
+		// The public key must be the one the private key derives.
+		if key.D.BitLen() > 256 {
+			return nil, fmt.Errorf("Invalid JWK EC key: private key is too long")
+		}
+		priv, err := ecdh.P256().NewPrivateKey(key.D.FillBytes(make([]byte, 32)))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JWK EC key: %v", err)
+		}
+		pub, err := key.PublicKey.ECDH()
+		if err != nil {
+			return nil, fmt.Errorf("Invalid JWK EC key: %v", err)
+		}
+		if !priv.PublicKey().Equal(pub) {
+			return nil, fmt.Errorf("Invalid JWK EC key: public key doesn't match")
+		}
+		return key, nil
+
+	default:
+		return nil, fmt.Errorf("Unsupported JWK key type '%s'", k.Kty)
+	}
+}
+
+// keyAlgorithm describes a public key for display, eg. "RSA-2048".
+func keyAlgorithm(pub crypto.PublicKey) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA-%d", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return fmt.Sprintf("ECDSA %s", k.Curve.Params().Name)
+	default:
+		return "Unknown"
+	}
+}
@@ -0,0 +1,105 @@
+package appengine
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func b64Int(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+// rsaJWK returns the JWK certbot saves an RSA account key as.
+func rsaJWK(key *rsa.PrivateKey) map[string]string {
+	key.Precompute()
+	return map[string]string{
+		"kty": "RSA",
+		"n":   b64Int(key.N),
+		"e":   b64Int(big.NewInt(int64(key.E))),
+		"d":   b64Int(key.D),
+		"p":   b64Int(key.Primes[0]),
+		"q":   b64Int(key.Primes[1]),
+		"dp":  b64Int(key.Precomputed.Dp),
+		"dq":  b64Int(key.Precomputed.Dq),
+		"qi":  b64Int(key.Precomputed.Qinv),
+	}
+}
+
+func ecJWK(key *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"crv": "P-256",
+		"x":   b64Int(key.X),
+		"y":   b64Int(key.Y),
+		"d":   b64Int(key.D),
+	}
+}
+
+func TestParseJWK(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherECKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mismatched := ecJWK(ecKey)
+	mismatched["x"] = b64Int(otherECKey.X)
+	mismatched["y"] = b64Int(otherECKey.Y)
+
+	missingD := ecJWK(ecKey)
+	delete(missingD, "d")
+
+	missingN := rsaJWK(rsaKey)
+	delete(missingN, "n")
+
+	p384 := ecJWK(ecKey)
+	p384["crv"] = "P-384"
+
+	tests := []struct {
+		name    string
+		jwk     map[string]string
+		wantKey interface{ Equal(crypto.PublicKey) bool }
+	}{
+		{"Certbot RSA key", rsaJWK(rsaKey), &rsaKey.PublicKey},
+		{"P-256 key", ecJWK(ecKey), &ecKey.PublicKey},
+		{"Mismatched x and y", mismatched, nil},
+		{"Missing EC d", missingD, nil},
+		{"Missing RSA n", missingN, nil},
+		{"Unsupported curve", p384, nil},
+		{"Unsupported key type", map[string]string{"kty": "oct", "k": "AAAA"}, nil},
+	}
+
+	Convey("Parses JWK account keys", t, func() {
+		for _, test := range tests {
+			Convey(test.name, func() {
+				data, err := json.Marshal(test.jwk)
+				So(err, ShouldBeNil)
+
+				key, err := parseAccountKey(data)
+				if test.wantKey == nil {
+					So(err, ShouldNotBeNil)
+					So(key, ShouldBeNil)
+					return
+				}
+				So(err, ShouldBeNil)
+				So(test.wantKey.Equal(key.Public()), ShouldBeTrue)
+			})
+		}
+	})
+}
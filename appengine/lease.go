@@ -0,0 +1,128 @@
+package appengine
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/log"
+)
+
+const (
+	// How long a hostname stays leased without the operation holding it
+	// making progress.  Longer than a task takes to run out of retries.
+	hostNameLeaseDuration = 30 * time.Minute
+)
+
+// leaseError is returned when another operation holds the lease on a
+// hostname.
+type leaseError struct {
+	HostName string
+	Since    time.Time
+}
+
+func (e *leaseError) Error() string {
+	return fmt.Sprintf("A certificate for %s is already in progress, started %s",
+		e.HostName, e.Since.Format("2 January 2006 15:04"))
+}
+
+// newLeaseID returns a random ID identifying an operation's leases.
+func newLeaseID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// acquireHostNameLeases leases every hostname to leaseID, so no other
+// operation can get a certificate for them at the same time.  Leases already
+// held by leaseID are extended.  It returns a *leaseError if another operation
+// holds any of them, in which case none are held afterwards.
+func acquireHostNameLeases(c context.Context, hostnames []string, leaseID string) error {
+	var acquired []string
+	for _, hostname := range hostnames {
+		key := hostNameLeaseKey(c, hostname)
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			var lease HostNameLease
+			err := datastore.Get(c, key, &lease)
+			switch {
+			case err == datastore.ErrNoSuchEntity:
+			case err != nil:
+				return err
+			case lease.Holder != leaseID && time.Now().Before(lease.Expires):
+				return &leaseError{hostname, lease.Acquired}
+			}
+
+			if lease.Holder != leaseID {
+				lease = HostNameLease{Holder: leaseID, Acquired: time.Now()}
+			}
+			lease.Expires = time.Now().Add(hostNameLeaseDuration)
+			_, err = datastore.Put(c, key, &lease)
+			return err
+		}, nil)
+		if err != nil {
+			releaseHostNameLeases(c, acquired, leaseID)
+			return err
+		}
+		acquired = append(acquired, hostname)
+	}
+	return nil
+}
+
+// releaseHostNameLeases gives up the leases leaseID holds on the hostnames.
+// Callers have nothing better to do if it fails, so a lease that can't be
+// released is only logged, and expires after hostNameLeaseDuration.
+func releaseHostNameLeases(c context.Context, hostnames []string, leaseID string) {
+	for _, hostname := range hostnames {
+		key := hostNameLeaseKey(c, hostname)
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			var lease HostNameLease
+			if err := datastore.Get(c, key, &lease); err == datastore.ErrNoSuchEntity {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if lease.Holder != leaseID {
+				return nil
+			}
+			return datastore.Delete(c, key)
+		}, nil)
+		if err != nil {
+			log.Warningf(c, "Failed to release lease on %s: %v", hostname, err)
+		}
+	}
+}
+
+// deleteExpiredHostNameLeases removes leases that have expired.  Each one is
+// checked again in a transaction before it's deleted, in case it was acquired
+// again since the query.
+func deleteExpiredHostNameLeases(c context.Context) error {
+	keys, err := datastore.NewQuery(hostNameLeaseKind).
+		Filter("Expires <", time.Now()).
+		KeysOnly().GetAll(c, nil)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		err := datastore.RunInTransaction(c, func(c context.Context) error {
+			var lease HostNameLease
+			if err := datastore.Get(c, key, &lease); err == datastore.ErrNoSuchEntity {
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if time.Now().Before(lease.Expires) {
+				return nil
+			}
+			return datastore.Delete(c, key)
+		}, nil)
+		if err != nil {
+			log.Warningf(c, "Failed to delete expired lease on %s: %v", key.StringID(), err)
+		}
+	}
+	return nil
+}
@@ -10,9 +10,16 @@ const (
 )
 
 func init() {
+	http.HandleFunc("/ssl-certificates/account", wrapHTTPHandler(handleAccount))
 	http.HandleFunc("/ssl-certificates/auto-renew", wrapHTTPHandler(handleAutoRenew))
 	http.HandleFunc("/ssl-certificates/create", wrapHTTPHandler(handleCreate))
+	http.HandleFunc("/ssl-certificates/csr", wrapHTTPHandler(handleCSR))
 	http.HandleFunc("/ssl-certificates/delete", wrapHTTPHandler(handleDelete))
+	http.HandleFunc("/ssl-certificates/directory", wrapHTTPHandler(handleDirectory))
+	http.HandleFunc("/ssl-certificates/operation", wrapHTTPHandler(handleOperation))
+	http.HandleFunc("/ssl-certificates/resume", wrapHTTPHandler(handleResume))
+	http.HandleFunc("/ssl-certificates/rollover", wrapHTTPHandler(handleRollover))
+	http.HandleFunc("/ssl-certificates/settings", wrapHTTPHandler(handleSettings))
 	http.HandleFunc("/ssl-certificates/status", wrapHTTPHandler(handleStatus))
 	http.HandleFunc(challengePathPrefix, wrapHTTPHandler(handleChallenge))
 	http.HandleFunc(selfTestPath, wrapHTTPHandler(handleSelfTest))
@@ -0,0 +1,174 @@
+package appengine
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/datastore"
+	"google.golang.org/appengine/delay"
+	"google.golang.org/appengine/log"
+)
+
+// The states a CreateOperation goes through once its order has been created.
+// Each state is named after the step that runs next:
+//
+//	accepting -> validating -> finalizing -> uploading -> mapping -> done
+//
+// Certificates for a provided CSR are done once they're issued.
+const (
+	stateAccepting  = "accepting"  // Challenge responses are ready for the CA.
+	stateValidating = "validating" // Waiting for the CA to validate the challenges.
+	stateFinalizing = "finalizing" // Waiting for the CA to issue the certificate.
+	stateUploading  = "uploading"  // Uploading the certificate to App Engine.
+	stateMapping    = "mapping"    // Making the certificate the domains' default.
+	stateDone       = "done"
+	stateFailed     = "failed" // The order can't be completed.
+
+	// Unfinished operations that haven't been advanced for this long lost their
+	// task, eg. to a deploy, and are resumed by the next auto-renew.
+	stalledOperationTimeout = time.Hour
+)
+
+// operationStep runs the step for an operation's state and moves it to the
+// next state.  Steps return an error to be retried later, or operationFinished
+// if the operation can't go any further.
+type operationStep func(context.Context, *CreateOperation) error
+
+var operationSteps = map[string]operationStep{
+	stateAccepting:  acceptChallenges,
+	stateValidating: validateOrder,
+	stateFinalizing: finalizeOrder,
+	stateUploading:  uploadCert,
+	stateMapping:    mapCert,
+}
+
+// advanceOperationFunc drives an operation through its steps until it's done
+// or has to wait for something.
+var advanceOperationFunc = delay.Func("advance-operation", advanceOperation)
+
+func advanceOperation(c context.Context, orderURI string) error {
+	cr, err := GetCreateOperation(c, orderURI)
+	if err != nil {
+		return fmt.Errorf("Failed to get operation %s: %v", orderURI, err)
+	}
+	if cr.IsFinished {
+		log.Infof(c, "Operation for %s is already finished", cr.HostName)
+		return nil
+	}
+
+	return updateOperation(c, cr, func() error {
+		// Extend our leases on the hostnames.  Another operation can only have
+		// them if ours expired while this one was stalled.  Operations started
+		// before there were leases don't have any.
+		if cr.LeaseID != "" {
+			var leaseErr *leaseError
+			if err := acquireHostNameLeases(c, cr.AllHostNames(), cr.LeaseID); errors.As(err, &leaseErr) {
+				cr.setError(err)
+				recordEvent(c, cr, OperationEvent{Type: eventError, Error: cr.Error})
+				return operationFinished
+			} else if err != nil {
+				return fmt.Errorf("Failed to lease hostnames: %v", err)
+			}
+		}
+
+		for {
+			step, ok := operationSteps[cr.State]
+			if !ok {
+				return fmt.Errorf("Can't advance an operation in state '%s'", cr.State)
+			}
+			from := cr.State
+			recordEvent(c, cr, OperationEvent{Type: eventStart})
+			if err := step(c, cr); err == operationFinished {
+				// The step recorded why the operation can't go on.
+				recordEvent(c, cr, OperationEvent{Type: eventError, Step: from, NextStep: cr.State, Error: cr.Error})
+				return err
+			} else if err != nil {
+				recordEvent(c, cr, OperationEvent{Type: eventError, Step: from, Error: redactSecrets(err.Error())})
+				return err
+			}
+			recordEvent(c, cr, OperationEvent{Type: eventFinish, Step: from, NextStep: cr.State})
+			log.Infof(c, "Operation for %s went from %s to %s", cr.HostName, from, cr.State)
+			if cr.State == stateDone {
+				return operationFinished
+			}
+
+			// Save our progress so we start from the next step if we're
+			// interrupted.
+			cr.Updated = time.Now()
+			if err := cr.Put(c); err != nil {
+				return fmt.Errorf("Failed to save operation: %v", err)
+			}
+		}
+	})
+}
+
+// resumeOperation restarts the driver task for an operation from the step it
+// stopped at.
+func resumeOperation(c context.Context, cr *CreateOperation) error {
+	log.Infof(c, "Resuming operation for %s from %s", cr.HostName, cr.State)
+	if cr.LeaseID == "" {
+		// Operations started before there were leases.
+		cr.LeaseID = newLeaseID()
+	}
+	if err := acquireHostNameLeases(c, cr.AllHostNames(), cr.LeaseID); err != nil {
+		return err
+	}
+	cr.IsFinished = false
+	cr.Error = ""
+	cr.Failure = OperationError{}
+	cr.Updated = time.Now()
+	if err := cr.Put(c); err != nil {
+		return fmt.Errorf("Failed to save operation: %v", err)
+	}
+	recordEvent(c, cr, OperationEvent{Type: eventResume})
+	return delayFunc(c, advanceOperationFunc, cr.OrderURI)
+}
+
+// resumeLegacyOperation picks up an operation started by a version that
+// queued a task for each step, from the step its task would have run.  update
+// copies anything the task was passed onto the operation.
+func resumeLegacyOperation(c context.Context, orderURI, state string, update func(*CreateOperation) error) error {
+	cr, err := GetCreateOperation(c, orderURI)
+	if err == datastore.ErrNoSuchEntity {
+		log.Infof(c, "Operation %s no longer exists", orderURI)
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("Failed to get operation %s: %v", orderURI, err)
+	}
+	if cr.IsFinished || cr.State != "" {
+		log.Infof(c, "Operation for %s is already finished or resumed", cr.HostName)
+		return nil
+	}
+	cr.State = state
+	if update != nil {
+		if err := update(cr); err != nil {
+			return err
+		}
+	}
+	return resumeOperation(c, cr)
+}
+
+// resumeStalledOperations resumes any unfinished operations that haven't been
+// advanced for a while.  It's run before auto-renew, so an operation that
+// can't be resumed is logged and tried again on the next run rather than
+// stopping the renewals.
+func resumeStalledOperations(c context.Context) {
+	ops, err := GetAllCreateOperations(c)
+	if err != nil {
+		log.Warningf(c, "Failed to get operations: %v", err)
+		return
+	}
+	for _, cr := range ops {
+		if _, ok := operationSteps[cr.State]; !ok || cr.IsFinished {
+			continue
+		}
+		if time.Since(cr.lastActive()) < stalledOperationTimeout {
+			continue
+		}
+		if err := resumeOperation(c, cr); err != nil {
+			log.Warningf(c, "Failed to resume operation for %s: %v", cr.HostName, err)
+		}
+	}
+}
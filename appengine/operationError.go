@@ -0,0 +1,193 @@
+package appengine
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/net/context"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/appengine/log"
+)
+
+// Categories of operation failures, so the status page can show at a glance
+// what went wrong.
+const (
+	errorCategoryDNS        = "dns"        // Looking up or creating DNS records.
+	errorCategoryCAA        = "caa"        // CAA records don't allow the CA.
+	errorCategoryChallenge  = "challenge"  // The CA couldn't validate a challenge.
+	errorCategoryRateLimit  = "rate-limit" // The CA rate limited us.
+	errorCategoryBudget     = "budget"     // Over our own rate limit budget.
+	errorCategoryAccount    = "account"    // Problems with our ACME account.
+	errorCategoryOrder      = "order"      // The CA won't issue what was asked for.
+	errorCategoryCA         = "ca"         // The CA had a problem of its own.
+	errorCategoryAppEngine  = "app-engine" // Uploading or mapping the certificate.
+	errorCategoryInProgress = "in-progress"
+	errorCategoryOther      = "other"
+
+	acmeErrorPrefix = "urn:ietf:params:acme:error:"
+)
+
+// acmeProblemCategories maps ACME problem types, without acmeErrorPrefix, to
+// categories.
+var acmeProblemCategories = map[string]string{
+	"dns":                     errorCategoryDNS,
+	"caa":                     errorCategoryCAA,
+	"connection":              errorCategoryChallenge,
+	"incorrectResponse":       errorCategoryChallenge,
+	"tls":                     errorCategoryChallenge,
+	"unauthorized":            errorCategoryChallenge,
+	"rateLimited":             errorCategoryRateLimit,
+	"accountDoesNotExist":     errorCategoryAccount,
+	"externalAccountRequired": errorCategoryAccount,
+	"invalidContact":          errorCategoryAccount,
+	"unsupportedContact":      errorCategoryAccount,
+	"userActionRequired":      errorCategoryAccount,
+	"badCSR":                  errorCategoryOrder,
+	"badRevocationReason":     errorCategoryOrder,
+	"rejectedIdentifier":      errorCategoryOrder,
+	"unsupportedIdentifier":   errorCategoryOrder,
+	"malformed":               errorCategoryOrder,
+	"badNonce":                errorCategoryCA,
+	"serverInternal":          errorCategoryCA,
+}
+
+// OperationError describes why an operation failed.
+type OperationError struct {
+	Step        string // State the operation was in, or "ordering" before there was one.
+	Category    string // See errorCategory*.
+	ProblemType string // ACME problem type, if the CA sent one.
+	Detail      string
+	Subproblems []OperationSubproblem
+	HTTPStatus  int  // From the CA or App Engine Admin API.
+	Retryable   bool // Whether trying again later might work.
+}
+
+// OperationSubproblem is the part of an ACME problem that applies to one
+// identifier.
+type OperationSubproblem struct {
+	Identifier  string
+	ProblemType string
+	Detail      string
+}
+
+// Label returns the Bootstrap label class to show the category with.
+func (e OperationError) Label() string {
+	if e.Retryable {
+		return "warning"
+	}
+	return "danger"
+}
+
+// ShortProblemType returns the ACME problem type without the standard prefix,
+// eg. "dns".
+func (e OperationError) ShortProblemType() string {
+	return strings.TrimPrefix(e.ProblemType, acmeErrorPrefix)
+}
+
+// classifyError describes an error that happened during the given step.
+func classifyError(step string, err error) OperationError {
+	ret := OperationError{
+		Step:     step,
+		Category: errorCategoryOther,
+		Detail:   redactSecrets(err.Error()),
+	}
+
+	var acmeErr *acme.Error
+	var caaErr *caaError
+	var budgetErr *budgetError
+	var leaseErr *leaseError
+	var apiErr *googleapi.Error
+	switch {
+	case errors.As(err, &acmeErr):
+		ret.ProblemType = acmeErr.ProblemType
+		ret.Detail = acmeErr.Detail
+		ret.HTTPStatus = acmeErr.StatusCode
+		if category, ok := acmeProblemCategories[strings.TrimPrefix(acmeErr.ProblemType, acmeErrorPrefix)]; ok {
+			ret.Category = category
+		} else if acmeErr.StatusCode >= http.StatusInternalServerError {
+			ret.Category = errorCategoryCA
+		}
+		for _, sp := range acmeErr.Subproblems {
+			sub := OperationSubproblem{ProblemType: sp.Type, Detail: sp.Detail}
+			if sp.Identifier != nil {
+				sub.Identifier = sp.Identifier.Value
+			}
+			ret.Subproblems = append(ret.Subproblems, sub)
+		}
+
+	case errors.As(err, &caaErr):
+		ret.Category = errorCategoryCAA
+	case errors.As(err, &budgetErr):
+		ret.Category = errorCategoryBudget
+	case errors.As(err, &leaseErr):
+		ret.Category = errorCategoryInProgress
+
+	case errors.As(err, &apiErr):
+		ret.Category = errorCategoryAppEngine
+		ret.HTTPStatus = apiErr.Code
+		if apiErr.Message != "" {
+			ret.Detail = apiErr.Message
+		}
+	}
+
+	switch ret.Category {
+	case errorCategoryDNS, errorCategoryRateLimit, errorCategoryBudget, errorCategoryCA, errorCategoryInProgress:
+		ret.Retryable = true
+	case errorCategoryAppEngine:
+		ret.Retryable = ret.HTTPStatus >= http.StatusInternalServerError || ret.HTTPStatus == http.StatusTooManyRequests
+	case errorCategoryOther:
+		// Probably a network problem.
+		ret.Retryable = true
+	}
+	return ret
+}
+
+// setError records why the operation failed.
+func (cr *CreateOperation) setError(err error) {
+	cr.Error = redactSecrets(err.Error())
+	cr.Failure = classifyError(cr.State, err)
+}
+
+// invalidOrderError returns the problem that made the order invalid.  The CA
+// puts the useful details on the challenges that failed, so those are used if
+// there are any.
+func invalidOrderError(c context.Context, client *acme.Client, cr *CreateOperation, order *acme.Order) error {
+	var ret *acme.Error
+	for _, a := range cr.Authorizations {
+		if a.ChallengeURI == "" {
+			continue
+		}
+		auth, err := client.GetAuthorization(c, a.URI)
+		if err != nil {
+			log.Warningf(c, "Failed to get authorization for %s: %v", a.HostName, err)
+			continue
+		}
+		for _, challenge := range auth.Challenges {
+			var problem *acme.Error
+			if challenge.Status != acme.StatusInvalid || !errors.As(challenge.Error, &problem) {
+				continue
+			}
+			if ret == nil {
+				// Use the first failed challenge's problem as a whole.
+				copied := *problem
+				ret = &copied
+				ret.Subproblems = nil
+			}
+			ret.Subproblems = append(ret.Subproblems, acme.Subproblem{
+				Type:       problem.ProblemType,
+				Detail:     problem.Detail,
+				Identifier: &acme.AuthzID{Type: "dns", Value: a.HostName},
+			})
+		}
+	}
+	if ret == nil {
+		ret = order.Error
+	}
+	if ret == nil {
+		return fmt.Errorf("Order is invalid")
+	}
+	return fmt.Errorf("Order is invalid: %w", ret)
+}
@@ -0,0 +1,42 @@
+package appengine
+
+import (
+	"crypto"
+	"fmt"
+	"io"
+	"regexp"
+)
+
+const (
+	redacted = "[REDACTED]"
+)
+
+// privateKeyPEMRegexp matches PEM-encoded private keys of any type.
+var privateKeyPEMRegexp = regexp.MustCompile(`(?s)-----BEGIN [A-Z0-9 ]*PRIVATE KEY-----.*?-----END [A-Z0-9 ]*PRIVATE KEY-----`)
+
+// privateKeyPEM is a PEM-encoded private key.  It's formatted as [REDACTED] by
+// the fmt and log packages so it can't end up in the logs by accident.
+type privateKeyPEM []byte
+
+func (privateKeyPEM) Format(f fmt.State, verb rune) {
+	io.WriteString(f, redacted)
+}
+
+// redactSecrets replaces any private keys in s, eg. an error message that
+// quotes a request, with [REDACTED].
+func redactSecrets(s string) string {
+	return privateKeyPEMRegexp.ReplaceAllString(s, redacted)
+}
+
+// checkTaskArgs returns an error if any of the arguments to a task are private
+// keys.  Task payloads are stored and shown in the console in plain text, so
+// tasks take IDs and load keys from datastore instead.
+func checkTaskArgs(args []interface{}) error {
+	for i, arg := range args {
+		switch arg.(type) {
+		case privateKeyPEM, crypto.Signer, *CertificateKey:
+			return fmt.Errorf("Argument %d to the task is a private key", i)
+		}
+	}
+	return nil
+}
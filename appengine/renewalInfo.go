@@ -0,0 +1,99 @@
+package appengine
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+	"google.golang.org/appengine/urlfetch"
+)
+
+const (
+	// How long to wait before asking the CA again if it doesn't say.
+	defaultRenewalInfoRetryAfter = 6 * time.Hour
+)
+
+// renewalInfo is the CA's response from its ACME Renewal Information (ARI)
+// endpoint.
+type renewalInfo struct {
+	SuggestedWindow struct {
+		Start time.Time `json:"start"`
+		End   time.Time `json:"end"`
+	} `json:"suggestedWindow"`
+	ExplanationURL string `json:"explanationURL"`
+
+	// From the Retry-After header.
+	RetryAfter time.Duration `json:"-"`
+}
+
+// ariCertID returns the identifier the CA uses for the certificate in ARI
+// requests: the base64url authority key identifier and serial number.
+func ariCertID(cert *x509.Certificate) (string, error) {
+	if len(cert.AuthorityKeyId) == 0 {
+		return "", fmt.Errorf("Certificate has no authority key identifier")
+	}
+
+	// The serial is DER encoded, so positive numbers with the top bit set need
+	// a leading zero.
+	serial := cert.SerialNumber.Bytes()
+	if len(serial) > 0 && serial[0]&0x80 != 0 {
+		serial = append([]byte{0}, serial...)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(cert.AuthorityKeyId) + "." +
+		base64.RawURLEncoding.EncodeToString(serial), nil
+}
+
+// renewalInfoURL returns the CA's ARI endpoint, or "" if it doesn't have one.
+func renewalInfoURL(c context.Context, directoryURL string) (string, error) {
+	dir, err := fetchDirectoryExtensions(c, directoryURL)
+	if err != nil {
+		return "", err
+	}
+	return dir.RenewalInfo, nil
+}
+
+// fetchRenewalInfo asks the CA when the certificate should be renewed.
+func fetchRenewalInfo(c context.Context, endpoint string, cert *x509.Certificate) (*renewalInfo, error) {
+	certID, err := ariCertID(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := urlfetch.Client(c).Get(strings.TrimSuffix(endpoint, "/") + "/" + certID)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching renewal info for %s returned %s", certID, resp.Status)
+	}
+
+	var ret renewalInfo
+	if err := json.NewDecoder(resp.Body).Decode(&ret); err != nil {
+		return nil, fmt.Errorf("Failed to decode renewal info for %s: %v", certID, err)
+	}
+	if !ret.SuggestedWindow.End.After(ret.SuggestedWindow.Start) {
+		return nil, fmt.Errorf("Invalid renewal window %s - %s for %s",
+			ret.SuggestedWindow.Start, ret.SuggestedWindow.End, certID)
+	}
+
+	ret.RetryAfter = defaultRenewalInfoRetryAfter
+	if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+		ret.RetryAfter = time.Duration(secs) * time.Second
+	}
+	return &ret, nil
+}
+
+// randomTimeInWindow picks a time uniformly between start and end, so that
+// renewals are spread out as the CA intends.
+func randomTimeInWindow(start, end time.Time) time.Time {
+	return start.Add(time.Duration(rand.Int63n(int64(end.Sub(start)) + 1)))
+}
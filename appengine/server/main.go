@@ -0,0 +1,12 @@
+// Command server runs the ssl-certificates module on App Engine.
+package main
+
+import (
+	_ "github.com/hatstand/gacertsbot/appengine"
+
+	"google.golang.org/appengine"
+)
+
+func main() {
+	appengine.Main()
+}
@@ -1,10 +1,12 @@
 package appengine
 
 import (
+	"embed"
 	"fmt"
 	"net/http"
 	"time"
 
+	"github.com/flosch/pongo2"
 	"golang.org/x/net/context"
 	"google.golang.org/appengine"
 	"google.golang.org/appengine/delay"
@@ -24,7 +26,11 @@ var (
 // delayFunc creates and schedules a taskqueue task to run the given function
 // in a few seconds.  It schedules it on the appengine module and instance that
 // is serving the current request.  It configures some sensible retry options.
+// Private keys can't be passed as arguments, see checkTaskArgs.
 func delayFunc(c context.Context, fn *delay.Function, args ...interface{}) error {
+	if err := checkTaskArgs(args); err != nil {
+		return err
+	}
 	task, err := fn.Task(args...)
 	if err != nil {
 		return fmt.Errorf("Failed to create task: %v", err)
@@ -53,6 +59,19 @@ func delayFunc(c context.Context, fn *delay.Function, args ...interface{}) error
 	return nil
 }
 
+//go:embed *.html
+var templateFiles embed.FS
+
+// loadTemplate parses one of the HTML templates built into the binary, so
+// they're found wherever the app is run from.
+func loadTemplate(name string) *pongo2.Template {
+	data, err := templateFiles.ReadFile(name)
+	if err != nil {
+		panic(err)
+	}
+	return pongo2.Must(pongo2.FromBytes(data))
+}
+
 // HandlerFunc is an HTTP handler that takes a context and returns an error.
 type HandlerFunc func(context.Context, http.ResponseWriter, *http.Request) error
 
@@ -62,8 +81,9 @@ func wrapHTTPHandler(h HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		c := appengine.NewContext(r)
 		if err := h(c, w, r); err != nil {
-			log.Errorf(c, "%v", err)
-			http.Error(w, err.Error(), 500)
+			msg := redactSecrets(err.Error())
+			log.Errorf(c, "%s", msg)
+			http.Error(w, msg, 500)
 		}
 	}
 }
@@ -1,17 +1,25 @@
 module github.com/hatstand/gacertsbot
 
+go 1.20
+
 require (
 	cloud.google.com/go v0.0.0-20170807220850-a8d72565bb92
 	github.com/davidsansome/parallel v0.0.0-20170128014230-c888a3c15693
 	github.com/flosch/pongo2 v0.0.0-20170704123420-58f1f3387f7c
-	github.com/golang/protobuf v0.0.0-20170726212829-748d386b5c1e
-	github.com/jtolds/gls v4.2.1+incompatible // indirect
+	github.com/golang/protobuf v1.5.3
 	github.com/juju/errors v0.0.0-20170703010042-c7d06af17c68
-	github.com/smartystreets/assertions v0.0.0-20180927180507-b2de0cb4f26d // indirect
+	github.com/miekg/dns v1.1.56
 	github.com/smartystreets/goconvey v0.0.0-20181108003508-044398e4856c
-	golang.org/x/crypto v0.0.0-20170807222151-81db3efc71b5
-	golang.org/x/net v0.0.0-20170726083632-f5079bd7f6f7
+	golang.org/x/crypto v0.28.0
+	golang.org/x/net v0.21.0
 	golang.org/x/oauth2 v0.0.0-20170807180024-9a379c6b3e95
 	google.golang.org/api v0.0.0-20170807210121-5c4ffd5985e2
-	google.golang.org/appengine v0.0.0-20170814190942-d9a072cfa7b9
+	google.golang.org/appengine v1.6.8
+)
+
+require (
+	github.com/jtolds/gls v4.20.0+incompatible // indirect
+	github.com/smartystreets/assertions v0.0.0-20180927180507-b2de0cb4f26d // indirect
+	golang.org/x/sys v0.26.0 // indirect
+	google.golang.org/protobuf v1.32.0 // indirect
 )